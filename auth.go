@@ -0,0 +1,225 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : auth.go                                                        //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 12:41:09 by aallali                                  //
+//   Updated: 2026/10/17 12:41:09 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Authentication is a mutual HMAC challenge-response, the password itself
+// never crosses the wire:
+//
+//	host -> peer : salt, challenge (random host nonce)
+//	peer -> host : peer nonce, HMAC(key, "peer" | challenge | nonce | binding)
+//	host -> peer : status, HMAC(key, "host" | challenge | nonce | binding)
+//
+// key is PBKDF2-SHA256(Config.Password, salt, AuthIterations), slow enough
+// that someone who recorded an exchange cannot try many passwords against it.
+// binding is TLS keying material when the connection is encrypted, which ties
+// the proof to this very channel. Both sides then derive the same session
+// key from the nonces, a cleartext connection is sealed with it (seal.go).
+const (
+	NonceSize      = 32
+	SaltSize       = 16
+	AuthIterations = 200000
+)
+
+// AuthMessage carries one step of the challenge-response
+type AuthMessage struct {
+	Salt      []byte `json:"salt,omitempty"`      // Host salt for the password key
+	Challenge []byte `json:"challenge,omitempty"` // Host nonce
+	Nonce     []byte `json:"nonce,omitempty"`     // Peer nonce
+	Proof     []byte `json:"proof,omitempty"`     // HMAC proving knowledge of the password
+	Status    string `json:"status,omitempty"`    // "ok" or "failed"
+}
+
+// errAuthFailed means the password does not match, retrying will not help
+var errAuthFailed = errors.New("access denied")
+
+// pbkdf2 is PBKDF2 with HMAC-SHA256 (RFC 8018)
+func pbkdf2(password, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:size]
+}
+
+// authKeys remembers the last key derived, the host uses a single salt and a
+// peer reconnects to the same host, so the slow derivation runs once
+var authKeys struct {
+	password string
+	salt     []byte
+	key      []byte
+	mutex    sync.Mutex
+}
+
+func deriveAuthKey(password string, salt []byte) []byte {
+	authKeys.mutex.Lock()
+	defer authKeys.mutex.Unlock()
+	if authKeys.key == nil || authKeys.password != password || !hmac.Equal(authKeys.salt, salt) {
+		authKeys.key = pbkdf2([]byte(password), append([]byte("p2p-auth-v2"), salt...), AuthIterations, sha256.Size)
+		authKeys.password, authKeys.salt = password, append([]byte(nil), salt...)
+	}
+	return authKeys.key
+}
+
+var (
+	hostSalt     []byte
+	hostSaltOnce sync.Once
+)
+
+// authSalt returns the salt the host sends to every peer, a new one each run
+func authSalt() []byte {
+	hostSaltOnce.Do(func() {
+		hostSalt = make([]byte, SaltSize)
+		if _, err := rand.Read(hostSalt); err != nil {
+			panic(err)
+		}
+	})
+	return hostSalt
+}
+
+// channelBinding returns material unique to this TLS session, or nothing on
+// a cleartext connection
+func channelBinding(conn net.Conn) []byte {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	binding, err := state.ExportKeyingMaterial("p2p-auth", nil, 32)
+	if err != nil {
+		return nil
+	}
+	return binding
+}
+
+func authMAC(key []byte, label string, challenge, nonce, binding []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(challenge)
+	mac.Write(nonce)
+	mac.Write(binding)
+	return mac.Sum(nil)
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// authenticateConnection runs the host side, it returns the session key when
+// the peer proved it knows the password
+func authenticateConnection(conn net.Conn, password string) ([]byte, bool) {
+	// Set a timeout for authentication
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge, err := newNonce()
+	if err != nil {
+		return nil, false
+	}
+	salt := authSalt()
+	if err := writeControl(conn, 0, AuthMessage{Salt: salt, Challenge: challenge}); err != nil {
+		return nil, false
+	}
+
+	var authMessage AuthMessage
+	if err := readControl(conn, &authMessage); err != nil {
+		return nil, false
+	}
+	if len(authMessage.Nonce) != NonceSize {
+		return nil, false
+	}
+
+	key := deriveAuthKey(password, salt)
+	binding := channelBinding(conn)
+	expected := authMAC(key, "peer", challenge, authMessage.Nonce, binding)
+
+	// Send authentication response
+	response := AuthMessage{Status: "failed"}
+	ok := hmac.Equal(authMessage.Proof, expected)
+	if ok {
+		response.Status = "ok"
+		response.Proof = authMAC(key, "host", challenge, authMessage.Nonce, binding)
+	}
+	writeControl(conn, 0, response)
+
+	if !ok {
+		return nil, false
+	}
+	return authMAC(key, "session", challenge, authMessage.Nonce, binding), true
+}
+
+// authenticateWithHost runs the peer side and checks that the host knows the
+// password too, so a rogue host cannot pretend to accept us
+func authenticateWithHost(conn net.Conn, password string) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	var challenge AuthMessage
+	if err := readControl(conn, &challenge); err != nil {
+		return nil, fmt.Errorf("failed to receive challenge: %v", err)
+	}
+	if len(challenge.Challenge) != NonceSize || len(challenge.Salt) != SaltSize {
+		return nil, fmt.Errorf("%w: invalid challenge from host", errAuthFailed)
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	key := deriveAuthKey(password, challenge.Salt)
+	binding := channelBinding(conn)
+	proof := authMAC(key, "peer", challenge.Challenge, nonce, binding)
+	if err := writeControl(conn, 0, AuthMessage{Nonce: nonce, Proof: proof}); err != nil {
+		return nil, fmt.Errorf("failed to send authentication: %v", err)
+	}
+
+	var response AuthMessage
+	if err := readControl(conn, &response); err != nil {
+		return nil, fmt.Errorf("failed to receive authentication response: %v", err)
+	}
+	if response.Status != "ok" {
+		return nil, fmt.Errorf("%w: invalid password or peer is unavailable", errAuthFailed)
+	}
+	if !hmac.Equal(response.Proof, authMAC(key, "host", challenge.Challenge, nonce, binding)) {
+		return nil, fmt.Errorf("%w: host could not prove it knows the password", errAuthFailed)
+	}
+	return authMAC(key, "session", challenge.Challenge, nonce, binding), nil
+}
@@ -0,0 +1,128 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : auth_test.go                                                   //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 12:58:16 by aallali                                  //
+//   Updated: 2026/10/17 12:58:16 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914 section 11
+	cases := []struct {
+		password, salt string
+		iterations     int
+		expected       string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, c := range cases {
+		key := pbkdf2([]byte(c.password), []byte(c.salt), c.iterations, 64)
+		if hex.EncodeToString(key) != c.expected {
+			t.Errorf("pbkdf2(%q, %q, %d) = %x", c.password, c.salt, c.iterations, key)
+		}
+	}
+}
+
+// authenticate runs both sides of the challenge-response over a pipe
+func authenticate(hostPassword, peerPassword string) (hostKey []byte, hostOK bool, peerKey []byte, peerErr error) {
+	host, peer := net.Pipe()
+	defer host.Close()
+	defer peer.Close()
+	done := make(chan struct{})
+	go func() {
+		hostKey, hostOK = authenticateConnection(host, hostPassword)
+		close(done)
+	}()
+	peerKey, peerErr = authenticateWithHost(peer, peerPassword)
+	<-done
+	return
+}
+
+func TestAuthenticate(t *testing.T) {
+	hostKey, hostOK, peerKey, err := authenticate("secret", "secret")
+	if !hostOK || err != nil {
+		t.Fatalf("good password refused: host %v, peer %v", hostOK, err)
+	}
+	if !bytes.Equal(hostKey, peerKey) {
+		t.Errorf("session keys differ")
+	}
+
+	_, hostOK, _, err = authenticate("secret", "guess")
+	if hostOK || !errors.Is(err, errAuthFailed) {
+		t.Errorf("bad password accepted: host %v, peer %v", hostOK, err)
+	}
+}
+
+func TestSealedConn(t *testing.T) {
+	key := []byte("session key")
+	hostConn, peerConn := net.Pipe()
+	host, peer := sealConn(hostConn, key, true), sealConn(peerConn, key, false)
+	defer host.Close()
+	defer peer.Close()
+
+	message := bytes.Repeat([]byte("0123456789"), MaxRecordSize/4)
+	go func() {
+		peer.Write(message)
+		peer.Write([]byte("end"))
+	}()
+	received := make([]byte, len(message)+3)
+	if _, err := io.ReadFull(host, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, append(message, "end"...)) {
+		t.Errorf("sealed bytes changed on the way")
+	}
+}
+
+func TestSealedConnRefusesTampering(t *testing.T) {
+	key := []byte("session key")
+	record := func(seal func(net.Conn) net.Conn, data []byte) []byte {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		go func() { seal(a).Write(data) }()
+		raw := make([]byte, 4+len(data)+RecordMACSize)
+		io.ReadFull(b, raw)
+		return raw
+	}
+	fromPeer := func(c net.Conn) net.Conn { return sealConn(c, key, false) }
+	fromHost := func(c net.Conn) net.Conn { return sealConn(c, key, true) }
+
+	good := record(fromPeer, []byte("hello"))
+	flipped := append([]byte(nil), good...)
+	flipped[5] ^= 1
+	cases := []struct {
+		name string
+		wire []byte
+	}{
+		{"flipped byte", flipped},
+		{"replayed", append(append([]byte(nil), good...), good...)},
+		{"reflected", record(fromHost, []byte("hello"))},
+		{"wrong key", record(func(c net.Conn) net.Conn { return sealConn(c, []byte("other"), false) }, []byte("hello"))},
+	}
+	for _, c := range cases {
+		a, b := net.Pipe()
+		go func() { a.Write(c.wire); a.Close() }()
+		host := sealConn(b, key, true)
+		// A replayed record is refused once the first copy was read
+		if _, err := io.ReadAll(host); !errors.Is(err, errBadRecord) {
+			t.Errorf("%s: read %v, expected a refused record", c.name, err)
+		}
+		b.Close()
+	}
+}
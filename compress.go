@@ -0,0 +1,101 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : compress.go                                                    //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 22:08:14 by aallali                                  //
+//   Updated: 2026/10/17 22:08:14 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Compression
+//
+// When both nodes enable Config.Compress, data frames may be deflated one by
+// one and carry FlagCompressed. Each frame is compressed on its own so the
+// receiver never needs state across frames, and a frame that does not shrink
+// is sent as is. Files that are compressed already are detected by extension
+// or by compressing a sample, and sent raw.
+const (
+	CompressSample  = 64 * 1024 // Bytes compressed to guess whether a file is worth it
+	CompressMinGain = 0.9       // A sample must shrink below this ratio
+)
+
+// Extensions of formats that are compressed already
+var compressedExtensions = map[string]bool{
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true,
+	".mp3": true, ".mp4": true, ".mkv": true, ".mov": true, ".avi": true, ".ogg": true, ".flac": true, ".webm": true,
+	".pdf": true, ".docx": true, ".xlsx": true, ".pptx": true, ".jar": true, ".apk": true,
+}
+
+var errInflate = errors.New("compressed chunk too large")
+
+// compressor deflates the chunks of one transfer
+type compressor struct {
+	writer *flate.Writer
+	buffer bytes.Buffer
+}
+
+// newCompressor returns nil when the file is not worth compressing
+func newCompressor(file *os.File, name string) *compressor {
+	if compressedExtensions[strings.ToLower(filepath.Ext(name))] {
+		return nil
+	}
+	c := &compressor{}
+	c.writer, _ = flate.NewWriter(&c.buffer, flate.BestSpeed) // Only fails on a bad level
+
+	sample := make([]byte, CompressSample)
+	n, err := file.ReadAt(sample, 0)
+	if err != nil && err != io.EOF {
+		return nil
+	}
+	compressed := c.compress(sample[:n])
+	if compressed == nil || float64(len(compressed))/float64(n) > CompressMinGain {
+		return nil
+	}
+	return c
+}
+
+// compress returns the deflated chunk, nil when it does not get smaller. The
+// result is only valid until the next call
+func (c *compressor) compress(chunk []byte) []byte {
+	c.buffer.Reset()
+	c.writer.Reset(&c.buffer)
+	if _, err := c.writer.Write(chunk); err != nil {
+		return nil
+	}
+	if err := c.writer.Close(); err != nil {
+		return nil
+	}
+	if c.buffer.Len() >= len(chunk) {
+		return nil
+	}
+	return c.buffer.Bytes()
+}
+
+// inflateChunk undoes compress, refusing anything bigger than a frame
+func inflateChunk(payload []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(payload))
+	defer reader.Close()
+	chunk, err := io.ReadAll(io.LimitReader(reader, MaxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(chunk) > MaxFrameSize {
+		return nil, errInflate
+	}
+	return chunk, nil
+}
@@ -0,0 +1,90 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : compress_test.go                                               //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 22:21:37 by aallali                                  //
+//   Updated: 2026/10/17 22:21:37 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	c := &compressor{}
+	c.writer, _ = flate.NewWriter(&c.buffer, flate.BestSpeed)
+
+	text := bytes.Repeat([]byte("the same line over and over\n"), ChunkSize/28)
+	compressed := c.compress(text)
+	if compressed == nil || len(compressed) >= len(text) {
+		t.Fatalf("text did not shrink")
+	}
+	chunk, err := inflateChunk(compressed)
+	if err != nil || !bytes.Equal(chunk, text) {
+		t.Fatalf("inflateChunk = %d bytes, %v", len(chunk), err)
+	}
+
+	noise := make([]byte, ChunkSize)
+	rand.New(rand.NewSource(1)).Read(noise)
+	if c.compress(noise) != nil {
+		t.Errorf("random bytes compressed")
+	}
+}
+
+func TestNewCompressor(t *testing.T) {
+	dir := t.TempDir()
+	noise := make([]byte, 2*CompressSample)
+	rand.New(rand.NewSource(1)).Read(noise)
+	text := bytes.Repeat([]byte("0123456789"), CompressSample/5)
+
+	cases := []struct {
+		name     string
+		content  []byte
+		expected bool
+	}{
+		{"notes.txt", text, true},
+		{"NOTES.ZIP", text, false}, // Compressed formats are trusted by extension
+		{"noise.bin", noise, false},
+		{"empty.txt", nil, false},
+	}
+	for _, c := range cases {
+		path := filepath.Join(dir, c.name)
+		if err := os.WriteFile(path, c.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := newCompressor(file, c.name) != nil; got != c.expected {
+			t.Errorf("%s: compressed %v, expected %v", c.name, got, c.expected)
+		}
+		file.Close()
+	}
+}
+
+func TestInflateChunkRefused(t *testing.T) {
+	// A tiny payload must not inflate past a frame
+	var bomb bytes.Buffer
+	writer, _ := flate.NewWriter(&bomb, flate.BestCompression)
+	writer.Write(make([]byte, MaxFrameSize+1))
+	writer.Close()
+	if _, err := inflateChunk(bomb.Bytes()); !errors.Is(err, errInflate) {
+		t.Errorf("oversized chunk: %v", err)
+	}
+
+	if _, err := inflateChunk([]byte("not deflate")); err == nil {
+		t.Errorf("garbage inflated")
+	}
+}
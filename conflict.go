@@ -0,0 +1,221 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : conflict.go                                                    //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 20:47:09 by aallali                                  //
+//   Updated: 2026/10/17 20:47:09 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conflicts
+//
+// Each node remembers, per peer and per path, the hash of the last version
+// both sides agreed on: the one it sent or received. An upload carries the
+// sender's copy of that hash as its base. When the receiver's file changed
+// since then too, both sides edited it: the receiver keeps its own version
+// and saves the incoming one next to it as "name.conflict-<node>-<time>.ext".
+// The hashes are kept in SyncedFile, so edits made while the nodes were apart
+// are caught as well.
+
+// syncedKey identifies a file shared with one peer
+type syncedKey struct {
+	node string
+	path string // Wire path, relative to the shared folder
+}
+
+const (
+	SyncedFile      = ".p2p/synced.json" // Last agreed hashes, inside the shared folder
+	SyncedSaveDelay = time.Second        // Groups the saves, a folder sync records one hash per file
+)
+
+var (
+	syncedHashes      = make(map[syncedKey]string)
+	syncedHashesMutex sync.Mutex
+
+	syncedPath  string      // Where SyncedFile is saved, empty until loadSynced
+	syncedTimer *time.Timer // Pending saveSyncedSoon, guarded by syncedSaveMutex
+
+	syncedSaveMutex sync.Mutex // Keeps writes of SyncedFile in order
+)
+
+// recordSynced remembers that the peer now has the same version of a file
+func recordSynced(session *Session, rel, hash string) {
+	syncedHashesMutex.Lock()
+	syncedHashes[syncedKey{session.Info.NodeID, rel}] = hash
+	syncedHashesMutex.Unlock()
+	saveSyncedSoon()
+}
+
+// syncedHash returns the hash of the last version agreed with the peer, ""
+// when the file never went either way
+func syncedHash(session *Session, rel string) string {
+	syncedHashesMutex.Lock()
+	defer syncedHashesMutex.Unlock()
+	return syncedHashes[syncedKey{session.Info.NodeID, rel}]
+}
+
+// loadSynced restores the hashes saved by the last run, later changes are
+// saved to the same file
+func loadSynced(config Config) {
+	syncedSaveMutex.Lock()
+	syncedPath = filepath.Join(config.Folder, filepath.FromSlash(SyncedFile))
+	syncedSaveMutex.Unlock()
+
+	data, err := os.ReadFile(syncedPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logMessage("Error reading %s: %v\n", SyncedFile, err)
+		}
+		return
+	}
+	// Node id, then wire path, to the last agreed hash
+	var saved map[string]map[string]string
+	if err := json.Unmarshal(data, &saved); err != nil {
+		logMessage("Ignoring %s: %v\n", SyncedFile, err)
+		return
+	}
+	syncedHashesMutex.Lock()
+	defer syncedHashesMutex.Unlock()
+	for node, paths := range saved {
+		for path, hash := range paths {
+			syncedHashes[syncedKey{node, path}] = hash
+		}
+	}
+}
+
+// saveSyncedSoon saves the hashes after SyncedSaveDelay, changes made
+// meanwhile go in the same write
+func saveSyncedSoon() {
+	syncedSaveMutex.Lock()
+	defer syncedSaveMutex.Unlock()
+	if syncedPath != "" && syncedTimer == nil {
+		syncedTimer = time.AfterFunc(SyncedSaveDelay, saveSynced)
+	}
+}
+
+func saveSynced() {
+	syncedSaveMutex.Lock()
+	defer syncedSaveMutex.Unlock()
+	syncedTimer = nil
+
+	saved := make(map[string]map[string]string)
+	syncedHashesMutex.Lock()
+	for key, hash := range syncedHashes {
+		if saved[key.node] == nil {
+			saved[key.node] = make(map[string]string)
+		}
+		saved[key.node][key.path] = hash
+	}
+	syncedHashesMutex.Unlock()
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		logMessage("Error saving %s: %v\n", SyncedFile, err)
+		return
+	}
+	// Write aside then rename, a crash never leaves half a file
+	temp := syncedPath + ".tmp"
+	err = os.MkdirAll(filepath.Dir(syncedPath), 0755)
+	if err == nil {
+		err = os.WriteFile(temp, data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(temp, syncedPath)
+	}
+	if err != nil {
+		logMessage("Error saving %s: %v\n", SyncedFile, err)
+	}
+}
+
+// inSync reports whether the peer already has the current content of a file,
+// typically one it just sent us. Only hashes computed since the file last
+// changed count, it never hashes the file itself
+func inSync(session *Session, filePath, rel string) bool {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false
+	}
+	hash := lookupHash(filePath, info)
+	return hash != "" && hash == syncedHash(session, rel)
+}
+
+// Conflict is an upload that was saved aside because both sides changed the file
+type Conflict struct {
+	Time    time.Time
+	Peer    string // Session the conflicting version came from
+	Path    string // The file, as it is on the wire
+	SavedAs string // Where the peer's version was saved
+}
+
+var (
+	conflicts      []Conflict
+	conflictsMutex sync.Mutex
+)
+
+// detectConflict reports whether an upload would overwrite local changes the
+// sender never saw
+func detectConflict(session *Session, assembly *FileAssembly) bool {
+	info, err := os.Stat(assembly.Path)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	local := lookupHash(assembly.Path, info)
+	if local == "" {
+		if local, err = hashFile(assembly.Path); err != nil {
+			return false
+		}
+	}
+
+	last := syncedHash(session, assembly.Name)
+	switch {
+	case local == assembly.Hash, local == assembly.Base:
+		return false // Same content, or the sender's version is based on ours
+	case last == "" || local == last:
+		return false // Never shared, or unchanged here since it was
+	}
+	return true
+}
+
+// conflictPath names the copy of the peer's version of filePath
+func conflictPath(session *Session, filePath string) string {
+	node := session.Info.NodeID
+	if len(node) > 8 {
+		node = node[:8]
+	}
+	ext := filepath.Ext(filePath)
+	base := strings.TrimSuffix(filePath, ext)
+	return fmt.Sprintf("%s.conflict-%s-%s%s", base, node, time.Now().Format("20060102-150405"), ext)
+}
+
+func recordConflict(session *Session, rel, savedAs string) {
+	conflictsMutex.Lock()
+	conflicts = append(conflicts, Conflict{Time: time.Now(), Peer: session.String(), Path: rel, SavedAs: savedAs})
+	conflictsMutex.Unlock()
+}
+
+// listConflicts returns the conflicts seen since startup, oldest first
+func listConflicts() []Conflict {
+	conflictsMutex.Lock()
+	defer conflictsMutex.Unlock()
+	return append([]Conflict(nil), conflicts...)
+}
+
+func clearConflicts() {
+	conflictsMutex.Lock()
+	conflicts = nil
+	conflictsMutex.Unlock()
+}
@@ -0,0 +1,394 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : delta.go                                                       //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 21:26:51 by aallali                                  //
+//   Updated: 2026/10/17 21:26:51 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Delta transfer
+//
+// When the receiver already has a version of the file, it answers "upload"
+// with the signature of that version: a weak rolling checksum and a strong
+// hash for every block. The sender slides a window over the new content and,
+// wherever the window matches a block, tells the receiver to copy that block
+// from its own copy instead of sending the bytes. Data frames of a delta
+// upload carry FlagDelta and hold a list of operations:
+//
+//	| 'C' (1) | block (4) |              copy one block of the receiver's copy
+//	| 'L' (1) | length (4) | bytes |     literal bytes
+//
+// The whole file hash is still checked once the file is rebuilt, a retry after
+// a mismatch sends the full file.
+const (
+	DeltaMinSize    = 64 * 1024 // Smaller files are always sent in full
+	DeltaBlockSize  = 8 * 1024  // Block size for files up to DeltaBlockSize*MaxDeltaBlocks
+	MaxDeltaBlocks  = 32 * 1024 // Caps the signature at 384KB
+	MaxDeltaBlock   = ChunkSize // Largest block, bigger files are always sent in full
+	DeltaStrongSize = 8         // Bytes of SHA-256 kept per block
+	DeltaLiteralMax = 64 * 1024 // Literal bytes per operation
+)
+
+const (
+	deltaCopy    byte = 'C'
+	deltaLiteral byte = 'L'
+)
+
+var errBadDelta = errors.New("malformed delta")
+
+// Signature describes the receiver's copy of a file block by block
+type Signature struct {
+	BlockSize int    `json:"blockSize"`
+	Size      int64  `json:"size"` // Size of the receiver's copy
+	Sums      []byte `json:"sums"` // Weak checksum (4) then strong hash (DeltaStrongSize) of every block
+}
+
+// validate checks a signature that came from the peer before it drives the
+// encoder: a zero block size would match empty windows forever and a huge one
+// would size its buffers
+func (s *Signature) validate() error {
+	if s.BlockSize <= 0 || s.BlockSize > MaxDeltaBlock {
+		return fmt.Errorf("%w: block size %d", errBadDelta, s.BlockSize)
+	}
+	if s.Size < 0 || len(s.Sums)%(4+DeltaStrongSize) != 0 {
+		return fmt.Errorf("%w: %d bytes of sums", errBadDelta, len(s.Sums))
+	}
+	if want := (s.Size + int64(s.BlockSize) - 1) / int64(s.BlockSize); int64(s.blocks()) != want {
+		return fmt.Errorf("%w: %d blocks for %d bytes", errBadDelta, s.blocks(), s.Size)
+	}
+	return nil
+}
+
+func (s *Signature) blocks() int {
+	return len(s.Sums) / (4 + DeltaStrongSize)
+}
+
+// blockLength is the size of block i, the last one may be short
+func (s *Signature) blockLength(i int) int {
+	if rest := s.Size - int64(i)*int64(s.BlockSize); rest < int64(s.BlockSize) {
+		return int(rest)
+	}
+	return s.BlockSize
+}
+
+func (s *Signature) weak(i int) uint32 {
+	return binary.BigEndian.Uint32(s.Sums[i*(4+DeltaStrongSize):])
+}
+
+func (s *Signature) strong(i int) []byte {
+	start := i*(4+DeltaStrongSize) + 4
+	return s.Sums[start : start+DeltaStrongSize]
+}
+
+func strongSum(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:DeltaStrongSize]
+}
+
+// rollingSum is the rsync weak checksum of a window, it can slide one byte at
+// a time without looking at the rest of the window
+type rollingSum struct {
+	a, b uint32
+	size uint32
+}
+
+func newRollingSum(window []byte) rollingSum {
+	r := rollingSum{size: uint32(len(window))}
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+	return r
+}
+
+func (r *rollingSum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.size*uint32(out)
+}
+
+func (r rollingSum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// computeSignature reads the receiver's copy of a file
+func computeSignature(file *os.File, size int64) (*Signature, error) {
+	blockSize := DeltaBlockSize
+	if size > int64(blockSize)*MaxDeltaBlocks {
+		blockSize = int((size + MaxDeltaBlocks - 1) / MaxDeltaBlocks)
+	}
+	if blockSize > MaxDeltaBlock {
+		return nil, fmt.Errorf("too large for a delta (%d bytes)", size)
+	}
+	signature := &Signature{BlockSize: blockSize, Size: size}
+
+	block := make([]byte, blockSize)
+	for offset := int64(0); offset < size; offset += int64(blockSize) {
+		n, err := file.ReadAt(block, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		signature.Sums = binary.BigEndian.AppendUint32(signature.Sums, newRollingSum(block[:n]).sum())
+		signature.Sums = append(signature.Sums, strongSum(block[:n])...)
+	}
+	return signature, nil
+}
+
+// deltaEncoder turns the sender's file into delta operations and hands them
+// over in frames of about frameSize bytes
+type deltaEncoder struct {
+	signature *Signature
+	blocks    map[uint32][]int // Weak checksum to the blocks that have it
+	frame     []byte
+	frameSize int
+	flush     func(frame []byte, position int64) error
+	position  int64 // Bytes of the file covered by the operations so far
+	literals  int64 // Bytes sent as literals
+}
+
+func newDeltaEncoder(signature *Signature, frameSize int, flush func(frame []byte, position int64) error) *deltaEncoder {
+	e := &deltaEncoder{
+		signature: signature,
+		blocks:    make(map[uint32][]int),
+		frame:     make([]byte, 0, frameSize+DeltaLiteralMax+5+ChecksumSize),
+		frameSize: frameSize,
+		flush:     flush,
+	}
+	for i := 0; i < signature.blocks(); i++ {
+		weak := signature.weak(i)
+		e.blocks[weak] = append(e.blocks[weak], i)
+	}
+	return e
+}
+
+// match finds a block of the receiver's copy holding exactly window
+func (e *deltaEncoder) match(weak uint32, window []byte) int {
+	candidates, exists := e.blocks[weak]
+	if !exists {
+		return -1
+	}
+	strong := strongSum(window)
+	for _, i := range candidates {
+		if e.signature.blockLength(i) == len(window) && string(e.signature.strong(i)) == string(strong) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *deltaEncoder) emit(op []byte, covered int) error {
+	if len(e.frame)+len(op) > e.frameSize {
+		if err := e.flushFrame(); err != nil {
+			return err
+		}
+	}
+	e.frame = append(e.frame, op...)
+	e.position += int64(covered)
+	return nil
+}
+
+func (e *deltaEncoder) copyBlock(i int) error {
+	op := binary.BigEndian.AppendUint32([]byte{deltaCopy}, uint32(i))
+	return e.emit(op, e.signature.blockLength(i))
+}
+
+func (e *deltaEncoder) literal(data []byte) error {
+	for len(data) > 0 {
+		n := min(len(data), DeltaLiteralMax)
+		op := binary.BigEndian.AppendUint32([]byte{deltaLiteral}, uint32(n))
+		if err := e.emit(append(op, data[:n]...), n); err != nil {
+			return err
+		}
+		e.literals += int64(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+func (e *deltaEncoder) flushFrame() error {
+	if len(e.frame) == 0 {
+		return nil
+	}
+	err := e.flush(e.frame, e.position)
+	e.frame = e.frame[:0]
+	return err
+}
+
+// encode reads r to the end and sends the operations rebuilding it
+func (e *deltaEncoder) encode(r io.Reader) error {
+	blockSize := e.signature.BlockSize
+	buffer := make([]byte, 0, 2*ChunkSize+blockSize)
+	pos, literalStart := 0, 0
+	eof := false
+	var rolling rollingSum
+	rollingValid := false
+
+	for {
+		// Keep a full window plus the next byte in the buffer
+		if len(buffer)-pos <= blockSize && !eof {
+			if err := e.literal(buffer[literalStart:pos]); err != nil {
+				return err
+			}
+			buffer = append(buffer[:0], buffer[pos:]...)
+			pos, literalStart = 0, 0
+			for len(buffer) < cap(buffer) && !eof {
+				n, err := r.Read(buffer[len(buffer):cap(buffer)])
+				buffer = buffer[:len(buffer)+n]
+				if err == io.EOF {
+					eof = true
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+
+		window := len(buffer) - pos
+		if window == 0 {
+			break
+		}
+		if window < blockSize {
+			// Only the receiver's last block can match a short tail
+			if i := e.match(newRollingSum(buffer[pos:]).sum(), buffer[pos:]); i >= 0 {
+				if err := e.literal(buffer[literalStart:pos]); err != nil {
+					return err
+				}
+				if err := e.copyBlock(i); err != nil {
+					return err
+				}
+				literalStart = len(buffer)
+			}
+			pos = len(buffer)
+			break
+		}
+
+		if !rollingValid {
+			rolling = newRollingSum(buffer[pos : pos+blockSize])
+			rollingValid = true
+		}
+		if i := e.match(rolling.sum(), buffer[pos:pos+blockSize]); i >= 0 {
+			if err := e.literal(buffer[literalStart:pos]); err != nil {
+				return err
+			}
+			if err := e.copyBlock(i); err != nil {
+				return err
+			}
+			pos += blockSize
+			literalStart = pos
+			rollingValid = false
+			continue
+		}
+
+		if pos+blockSize < len(buffer) {
+			rolling.roll(buffer[pos], buffer[pos+blockSize])
+		} else {
+			rollingValid = false
+		}
+		pos++
+		if pos-literalStart >= DeltaLiteralMax {
+			if err := e.literal(buffer[literalStart:pos]); err != nil {
+				return err
+			}
+			literalStart = pos
+		}
+	}
+
+	if err := e.literal(buffer[literalStart:pos]); err != nil {
+		return err
+	}
+	return e.flushFrame()
+}
+
+// applyDelta rebuilds part of the file from a delta frame, using the
+// receiver's copy for the copied blocks
+func (a *FileAssembly) applyDelta(ops []byte) error {
+	if a.BaseFile == nil || a.Signature == nil {
+		return fmt.Errorf("%w: no signature was sent", errBadDelta)
+	}
+	block := make([]byte, a.Signature.BlockSize)
+	for len(ops) > 0 {
+		if len(ops) < 5 {
+			return errBadDelta
+		}
+		op, value := ops[0], binary.BigEndian.Uint32(ops[1:5])
+		ops = ops[5:]
+
+		switch op {
+		case deltaCopy:
+			i := int(value)
+			if i >= a.Signature.blocks() {
+				return fmt.Errorf("%w: block %d out of range", errBadDelta, i)
+			}
+			n, err := a.BaseFile.ReadAt(block[:a.Signature.blockLength(i)], int64(i)*int64(a.Signature.BlockSize))
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if err := a.write(block[:n]); err != nil {
+				return err
+			}
+		case deltaLiteral:
+			if int(value) > len(ops) {
+				return errBadDelta
+			}
+			if err := a.write(ops[:value]); err != nil {
+				return err
+			}
+			ops = ops[value:]
+		default:
+			return fmt.Errorf("%w: unknown operation %q", errBadDelta, op)
+		}
+	}
+	return nil
+}
+
+// sendDelta sends the changes of file against the receiver's signature, it
+// stops early and returns the receiver's answer if it rejects the upload
+func sendDelta(t *Transfer, stream uint32, flags uint8, c *compressor, file *os.File, totalSize int64,
+	frameSize int, signature *Signature, progress *Progress, reply <-chan Message) (*Message, error) {
+	session := t.Session
+	var result *Message
+	errAnswered := errors.New("receiver answered")
+
+	encoder := newDeltaEncoder(signature, frameSize, func(frame []byte, position int64) error {
+		if err := t.checkStopped(stream, position, totalSize); err != nil {
+			return err
+		}
+		payload, chunkFlags := framePayload(frame, flags|FlagDelta, c)
+		if err := t.throttle(session.ctx, len(payload)); err != nil {
+			return errNotConnected
+		}
+		if err := session.sendChunk(stream, chunkFlags, payload); err != nil {
+			return fmt.Errorf("send error at %d/%d bytes: %v", position, totalSize, err)
+		}
+		progress.addWire(len(payload))
+		progress.set(position)
+		transfers.setProgress(t, position, totalSize)
+
+		if result = pollResult(reply); result != nil {
+			return errAnswered
+		}
+		return nil
+	})
+	if err := encoder.encode(file); err != nil && err != errAnswered {
+		return nil, err
+	}
+	if result == nil {
+		logMessage("Delta upload of %s: %d of %d bytes sent as data\n", t.Remote, encoder.literals, totalSize)
+	}
+	return result, nil
+}
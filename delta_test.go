@@ -0,0 +1,129 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : delta_test.go                                                  //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 21:49:02 by aallali                                  //
+//   Updated: 2026/10/17 21:49:02 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// roundTrip encodes content against a signature of base and rebuilds it the
+// way the receiver does, it returns the rebuilt file and the literal bytes sent
+func roundTrip(t *testing.T, base, content []byte, frameSize int) ([]byte, int64) {
+	t.Helper()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base")
+	if err := os.WriteFile(basePath, base, 0600); err != nil {
+		t.Fatal(err)
+	}
+	baseFile, err := os.Open(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer baseFile.Close()
+
+	signature, err := computeSignature(baseFile, int64(len(base)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signature.validate(); err != nil {
+		t.Fatalf("own signature rejected: %v", err)
+	}
+
+	tempFile, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempFile.Close()
+	assembly := &FileAssembly{TotalSize: int64(len(content)), TempFile: tempFile, BaseFile: baseFile, Signature: signature}
+
+	encoder := newDeltaEncoder(signature, frameSize, func(frame []byte, position int64) error {
+		if len(frame) > MaxFrameSize {
+			t.Fatalf("frame of %d bytes", len(frame))
+		}
+		return assembly.applyDelta(append([]byte(nil), frame...))
+	})
+	if err := encoder.encode(bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if encoder.position != int64(len(content)) {
+		t.Fatalf("encoder covered %d of %d bytes", encoder.position, len(content))
+	}
+
+	rebuilt, err := os.ReadFile(tempFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rebuilt, encoder.literals
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	base := make([]byte, 300*1024+123)
+	random.Read(base)
+	noise := make([]byte, 5000)
+	random.Read(noise)
+
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	cases := []struct {
+		name        string
+		content     []byte
+		maxLiterals int64
+	}{
+		{"identical", base, 0},
+		{"inserted", join(base[:100000], noise, base[100000:]), int64(len(noise) + DeltaBlockSize)},
+		{"appended", join(base, noise), int64(len(noise) + DeltaBlockSize)},
+		{"prepended", join(noise, base), int64(len(noise) + DeltaBlockSize)},
+		{"truncated", base[:len(base)-7000], DeltaBlockSize},
+		{"changed byte", join(base[:5000], []byte{base[5000] ^ 0xff}, base[5001:]), DeltaBlockSize},
+		{"empty", nil, 0},
+		{"unrelated", noise, int64(len(noise))},
+	}
+	for _, c := range cases {
+		for _, frameSize := range []int{ChunkSize, LimitBurst} {
+			rebuilt, literals := roundTrip(t, base, c.content, frameSize)
+			if !bytes.Equal(rebuilt, c.content) {
+				t.Errorf("%s (frames of %d): rebuilt %d bytes that differ from the %d sent", c.name, frameSize, len(rebuilt), len(c.content))
+			}
+			if literals > c.maxLiterals {
+				t.Errorf("%s (frames of %d): %d literal bytes, expected at most %d", c.name, frameSize, literals, c.maxLiterals)
+			}
+		}
+	}
+}
+
+func TestSignatureValidate(t *testing.T) {
+	entry := 4 + DeltaStrongSize
+	cases := []struct {
+		name      string
+		signature Signature
+		valid     bool
+	}{
+		{"good", Signature{BlockSize: 8, Size: 20, Sums: make([]byte, 3*entry)}, true},
+		{"empty file", Signature{BlockSize: 8, Size: 0}, true},
+		{"zero block size", Signature{BlockSize: 0, Size: 0, Sums: make([]byte, entry)}, false},
+		{"negative block size", Signature{BlockSize: -1, Size: 10, Sums: make([]byte, entry)}, false},
+		{"huge block size", Signature{BlockSize: MaxDeltaBlock + 1, Size: 10, Sums: make([]byte, entry)}, false},
+		{"partial entry", Signature{BlockSize: 8, Size: 8, Sums: make([]byte, entry+1)}, false},
+		{"too many blocks", Signature{BlockSize: 8, Size: 8, Sums: make([]byte, 2*entry)}, false},
+		{"too few blocks", Signature{BlockSize: 8, Size: 100, Sums: make([]byte, entry)}, false},
+		{"negative size", Signature{BlockSize: 8, Size: -8}, false},
+	}
+	for _, c := range cases {
+		if err := c.signature.validate(); (err == nil) != c.valid {
+			t.Errorf("%s: validate() = %v, valid %v expected", c.name, err, c.valid)
+		}
+	}
+}
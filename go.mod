@@ -2,10 +2,10 @@ module p2p
 
 go 1.22.2
 
-require github.com/fsnotify/fsnotify v1.8.0
-
 require (
-	github.com/chzyer/readline v1.5.1 // indirect
-	golang.org/x/sys v0.29.0 // indirect
-	golang.org/x/time v0.9.0 // indirect
+	github.com/chzyer/readline v1.5.1
+	github.com/fsnotify/fsnotify v1.8.0
+	golang.org/x/time v0.9.0
 )
+
+require golang.org/x/sys v0.29.0 // indirect
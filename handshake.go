@@ -0,0 +1,184 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : handshake.go                                                   //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 10:03:41 by aallali                                  //
+//   Updated: 2026/10/17 10:03:41 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Capabilities advertised in the hello exchange. A feature is only used on a
+// connection when both sides list it, so older builds keep working with the
+// subset they understand.
+const (
+	CapUpload   = "upload"   // push files with the "upload" action
+	CapResume   = "resume"   // receiver reports its offset, interrupted uploads continue
+	CapVerify   = "verify"   // checksummed chunks, receiver checks the file hash before saving
+	CapSync     = "sync"     // mirror the whole shared folder, only advertised when Config.Sync is on
+	CapCancel   = "cancel"   // sender tells the receiver to drop or keep the partial of a stopped upload
+	CapGet      = "get"      // fetch files and listings from the peer's shared folder
+	CapDelete   = "delete"   // deletes and renames of watched files are applied by the receiver
+	CapDelta    = "delta"    // only the changed blocks of a file the receiver already has are sent
+	CapCompress = "compress" // data frames may be deflated, only advertised when Config.Compress is on
+)
+
+// localCapabilities lists every feature this build supports
+var localCapabilities = []string{
+	CapUpload,
+	CapResume,
+	CapVerify,
+	CapSync,
+	CapCancel,
+	CapGet,
+	CapDelete,
+	CapDelta,
+	CapCompress,
+}
+
+// capabilitiesFor drops the features this node's config turned off
+func capabilitiesFor(config Config) []string {
+	caps := make([]string, 0, len(localCapabilities))
+	for _, c := range localCapabilities {
+		if c == CapSync && !config.Sync || c == CapCompress && !config.Compress {
+			continue
+		}
+		caps = append(caps, c)
+	}
+	return caps
+}
+
+// errIncompatible is returned when the two builds cannot talk to each other
+var errIncompatible = errors.New("incompatible peer")
+
+// HelloMessage is the first frame sent by each side of a connection
+type HelloMessage struct {
+	Protocol     int      `json:"protocol"`        // Wire protocol version
+	Version      string   `json:"version"`         // Application version
+	NodeID       string   `json:"nodeId"`          // Persistent id of the sender
+	Capabilities []string `json:"capabilities"`    // Features supported by the sender
+	Error        string   `json:"error,omitempty"` // Set by the host when it refuses the peer
+}
+
+// PeerInfo is what we learned about the remote side during the hello exchange
+type PeerInfo struct {
+	NodeID       string
+	Version      string
+	Capabilities map[string]bool // Negotiated: supported by both sides
+}
+
+func (p PeerInfo) supports(capability string) bool {
+	return p.Capabilities[capability]
+}
+
+func (p PeerInfo) String() string {
+	caps := make([]string, 0, len(p.Capabilities))
+	for c := range p.Capabilities {
+		caps = append(caps, c)
+	}
+	sort.Strings(caps)
+	return fmt.Sprintf("node %s v%s [%s]", p.NodeID, p.Version, strings.Join(caps, ", "))
+}
+
+func newNodeID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func localHello(config Config) HelloMessage {
+	return HelloMessage{
+		Protocol:     ProtocolVersion,
+		Version:      VERSION,
+		NodeID:       config.NodeID,
+		Capabilities: capabilitiesFor(config),
+	}
+}
+
+// negotiate checks the remote hello and keeps the capabilities both sides share
+func negotiate(config Config, remote HelloMessage) (PeerInfo, error) {
+	if remote.Protocol != ProtocolVersion {
+		return PeerInfo{}, fmt.Errorf("%w: protocol version mismatch: remote v%d (p2p %s), local v%d (p2p %s)",
+			errIncompatible, remote.Protocol, remote.Version, ProtocolVersion, VERSION)
+	}
+
+	info := PeerInfo{
+		NodeID:       remote.NodeID,
+		Version:      remote.Version,
+		Capabilities: make(map[string]bool),
+	}
+	for _, c := range remote.Capabilities {
+		for _, l := range capabilitiesFor(config) {
+			if c == l {
+				info.Capabilities[c] = true
+			}
+		}
+	}
+	return info, nil
+}
+
+// acceptHello runs the host side of the hello exchange, a peer is refused
+// when its certificate is not the one pinned for its node id. A new node id
+// comes back as a pin to save once the peer is authenticated
+func acceptHello(conn net.Conn, config Config) (PeerInfo, *pendingPin, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	var remote HelloMessage
+	if err := readControl(conn, &remote); err != nil {
+		return PeerInfo{}, nil, fmt.Errorf("reading hello: %v", err)
+	}
+
+	response := localHello(config)
+	var pin *pendingPin
+	info, err := negotiate(config, remote)
+	if err == nil {
+		pin, err = verifyPeerPinned(conn, info.NodeID)
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	if werr := writeControl(conn, 0, response); werr != nil && err == nil {
+		err = werr
+	}
+	return info, pin, err
+}
+
+// sendHello runs the peer side of the hello exchange
+func sendHello(conn net.Conn, config Config) (PeerInfo, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := writeControl(conn, 0, localHello(config)); err != nil {
+		return PeerInfo{}, fmt.Errorf("sending hello: %v", err)
+	}
+
+	var remote HelloMessage
+	if err := readControl(conn, &remote); err != nil {
+		return PeerInfo{}, fmt.Errorf("reading hello: %v", err)
+	}
+	info, err := negotiate(config, remote)
+	if err != nil {
+		return PeerInfo{}, err
+	}
+	if remote.Error != "" {
+		return PeerInfo{}, fmt.Errorf("host refused connection: %s", remote.Error)
+	}
+	return info, nil
+}
@@ -0,0 +1,259 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : ignore.go                                                      //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 23:31:48 by aallali                                  //
+//   Updated: 2026/10/17 23:31:48 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Ignore rules
+//
+// IgnoreFile, next to config.json, holds gitignore style patterns. Files and
+// directories matching them are left out of watched directories and patterns,
+// /up of a directory, folder sync, and what the peer can list or download:
+//
+//	*.swp       any file or directory with that name, at any depth
+//	build/      directories only
+//	/tmp/cache  a leading or inner "/" anchors the pattern to the working directory
+//	docs/**/*.o "**" spans any number of directories
+//	!keep.swp   a later "!" rule brings a file back, unless its directory is ignored
+//
+// Files named explicitly, with /up or /w, are sent whatever the rules say.
+
+// IgnoreFile holds the ignore rules, one pattern per line
+const IgnoreFile = ".p2pignore"
+
+// ignoreRule is one pattern of IgnoreFile
+type ignoreRule struct {
+	pattern  string // Without the "!" and the leading or trailing "/"
+	negate   bool
+	dirOnly  bool
+	anchored bool // Matched against the path from the working directory, not the name
+}
+
+var (
+	ignoreLines []string // IgnoreFile as is, comments included
+	ignoreRules []ignoreRule
+	ignoreMutex sync.RWMutex
+)
+
+// parseIgnoreRule returns false for blank lines, comments and bad patterns
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	if _, err := path.Match(line, ""); err != nil {
+		return ignoreRule{}, false
+	}
+	rule.pattern = line
+	return rule, true
+}
+
+// loadIgnoreRules reads IgnoreFile, a missing file means no rule
+func loadIgnoreRules() error {
+	file, err := os.Open(IgnoreFile)
+	if os.IsNotExist(err) {
+		setIgnoreLines(nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	setIgnoreLines(lines)
+	return nil
+}
+
+func setIgnoreLines(lines []string) {
+	var rules []ignoreRule
+	for _, line := range lines {
+		if rule, ok := parseIgnoreRule(line); ok {
+			rules = append(rules, rule)
+		}
+	}
+	ignoreMutex.Lock()
+	ignoreLines, ignoreRules = lines, rules
+	ignoreMutex.Unlock()
+}
+
+// saveIgnoreLines writes IgnoreFile and applies it
+func saveIgnoreLines(lines []string) error {
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	if err := os.WriteFile(IgnoreFile, []byte(content), 0644); err != nil {
+		return err
+	}
+	setIgnoreLines(lines)
+	return nil
+}
+
+// listIgnoreRules returns the lines of IgnoreFile holding a rule
+func listIgnoreRules() []string {
+	ignoreMutex.RLock()
+	defer ignoreMutex.RUnlock()
+	var rules []string
+	for _, line := range ignoreLines {
+		if _, ok := parseIgnoreRule(line); ok {
+			rules = append(rules, strings.TrimRight(line, " \t\r"))
+		}
+	}
+	return rules
+}
+
+// addIgnoreRule appends a pattern to IgnoreFile
+func addIgnoreRule(pattern string) error {
+	if _, ok := parseIgnoreRule(pattern); !ok {
+		return fmt.Errorf("invalid pattern: %q", pattern)
+	}
+	ignoreMutex.RLock()
+	lines := append([]string{}, ignoreLines...)
+	ignoreMutex.RUnlock()
+	return saveIgnoreLines(append(lines, pattern))
+}
+
+// removeIgnoreRule drops rule number index (as listed) from IgnoreFile
+func removeIgnoreRule(index int) (string, error) {
+	ignoreMutex.RLock()
+	lines := append([]string{}, ignoreLines...)
+	ignoreMutex.RUnlock()
+
+	for i, line := range lines {
+		if _, ok := parseIgnoreRule(line); !ok {
+			continue
+		}
+		if index == 0 {
+			return line, saveIgnoreLines(append(lines[:i], lines[i+1:]...))
+		}
+		index--
+	}
+	return "", fmt.Errorf("no such rule")
+}
+
+// matchSegments matches a slash separated path against a pattern where "**"
+// stands for any number of directories
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], name[0]); !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
+
+func (r ignoreRule) matches(rel string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+	if r.anchored {
+		return matchSegments(strings.Split(r.pattern, "/"), strings.Split(rel, "/"))
+	}
+	matched, _ := path.Match(r.pattern, path.Base(rel))
+	return matched
+}
+
+// ignoredRel applies the rules to one path, the last matching rule wins
+func ignoredRel(rules []ignoreRule, rel string, dir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.matches(rel, dir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// isIgnored reports whether a local file or directory is excluded by the
+// rules, or lives in an excluded directory
+func isIgnored(filePath string, dir bool) bool {
+	ignoreMutex.RLock()
+	rules := ignoreRules
+	ignoreMutex.RUnlock()
+	if len(rules) == 0 {
+		return false
+	}
+
+	// Paths outside of the working directory only match on their name
+	rel := filepath.Base(filePath)
+	if abs, err := filepath.Abs(filePath); err == nil {
+		if wd, err := os.Getwd(); err == nil {
+			if r, err := filepath.Rel(wd, abs); err == nil && r != ".." && !strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+				rel = filepath.ToSlash(r)
+			}
+		}
+	}
+	if rel == "." {
+		return false
+	}
+
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if ignoredRel(rules, strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return ignoredRel(rules, rel, dir)
+}
+
+// isIgnoredPath is isIgnored for a path that may be gone already, which then
+// matches either kind of rule
+func isIgnoredPath(filePath string) bool {
+	if info, err := os.Lstat(filePath); err == nil {
+		return isIgnored(filePath, info.IsDir())
+	}
+	return isIgnored(filePath, false) || isIgnored(filePath, true)
+}
@@ -0,0 +1,122 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : ignore_test.go                                                 //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 23:44:08 by aallali                                  //
+//   Updated: 2026/10/17 23:44:08 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIgnoreRule(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected ignoreRule
+		ok       bool
+	}{
+		{"*.swp", ignoreRule{pattern: "*.swp"}, true},
+		{"!keep.swp", ignoreRule{pattern: "keep.swp", negate: true}, true},
+		{"build/", ignoreRule{pattern: "build", dirOnly: true}, true},
+		{"/tmp/cache", ignoreRule{pattern: "tmp/cache", anchored: true}, true},
+		{"docs/**/*.o", ignoreRule{pattern: "docs/**/*.o", anchored: true}, true},
+		{"/out/ \r", ignoreRule{pattern: "out", dirOnly: true, anchored: true}, true},
+		{"", ignoreRule{}, false},
+		{"# comment", ignoreRule{}, false},
+		{"/", ignoreRule{}, false},
+		{"[bad", ignoreRule{}, false},
+	}
+	for _, c := range cases {
+		rule, ok := parseIgnoreRule(c.line)
+		if ok != c.ok || rule != c.expected {
+			t.Errorf("parseIgnoreRule(%q) = %+v, %v", c.line, rule, ok)
+		}
+	}
+}
+
+func TestIgnoredRel(t *testing.T) {
+	var rules []ignoreRule
+	for _, line := range []string{"*.swp", "!keep.swp", "build/", "/tmp/cache", "docs/**/*.o", "logs/*.log", "!logs/main.log"} {
+		rule, ok := parseIgnoreRule(line)
+		if !ok {
+			t.Fatalf("rule %q refused", line)
+		}
+		rules = append(rules, rule)
+	}
+	cases := []struct {
+		rel     string
+		dir     bool
+		ignored bool
+	}{
+		{"a.swp", false, true},
+		{"deep/down/a.swp", false, true}, // Unanchored rules match the name at any depth
+		{"keep.swp", false, false},       // Brought back by the later "!" rule
+		{"deep/keep.swp", false, false},
+		{"build", true, true},
+		{"src/build", true, true},
+		{"build", false, false}, // A trailing "/" only matches directories
+		{"tmp/cache", false, true},
+		{"src/tmp/cache", false, false}, // Anchored to the working directory
+		{"docs/a.o", false, true},       // "**" spans no directory at all
+		{"docs/x/y/a.o", false, true},
+		{"src/docs/a.o", false, false},
+		{"docs/a.c", false, false},
+		{"logs/debug.log", false, true},
+		{"logs/main.log", false, false},
+		{"logs/old/debug.log", false, false}, // "*" stops at "/"
+	}
+	for _, c := range cases {
+		if ignored := ignoredRel(rules, c.rel, c.dir); ignored != c.ignored {
+			t.Errorf("%s (dir %v): ignored %v, expected %v", c.rel, c.dir, ignored, c.ignored)
+		}
+	}
+}
+
+func TestIsIgnored(t *testing.T) {
+	work := inTempDir(t)
+	if err := saveIgnoreLines([]string{"# build output", "build/", "!build/keep.txt", "*.tmp"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { setIgnoreLines(nil) })
+
+	if rules := listIgnoreRules(); len(rules) != 3 {
+		t.Errorf("listed %q", rules)
+	}
+	cases := []struct {
+		path    string
+		dir     bool
+		ignored bool
+	}{
+		{"build", true, true},
+		{"build/out.bin", false, true},
+		{"build/keep.txt", false, true}, // Its directory stays ignored
+		{"src/main.go", false, false},
+		{filepath.Join(work, "a.tmp"), false, true},
+		{"../elsewhere/b.tmp", false, true}, // Outside of the working directory only the name counts
+		{".", true, false},
+	}
+	for _, c := range cases {
+		if ignored := isIgnored(filepath.FromSlash(c.path), c.dir); ignored != c.ignored {
+			t.Errorf("%s: ignored %v, expected %v", c.path, ignored, c.ignored)
+		}
+	}
+
+	// A path that is gone matches either kind of rule
+	if !isIgnoredPath("gone/build") {
+		t.Errorf("removed directory not ignored")
+	}
+	if err := os.WriteFile("build", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if isIgnoredPath("build") {
+		t.Errorf("file taken for a directory")
+	}
+}
@@ -0,0 +1,128 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : limit.go                                                       //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 22:44:30 by aallali                                  //
+//   Updated: 2026/10/17 22:44:30 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Bandwidth limits
+//
+// Everything a node sends goes through one token bucket and everything it
+// receives through another, shared by all sessions. On top of that each upload
+// has its own bucket, limited by our per file upload limit and by the per file
+// download limit the receiver asks for in "upload-ack". Limits are in KB/s,
+// 0 means unlimited.
+//
+// Only data frames pay, and they pay before the session's write lock is taken
+// (or once they are read), so control frames such as "upload-ack" get through
+// a saturated link. While any limit is set on either side, uploads use frames
+// of LimitBurst bytes so a control frame never waits long behind one.
+
+// LimitBurst is the most bytes a bucket lets through at once
+const LimitBurst = 64 * 1024
+
+// Limits holds the current limits in KB/s
+type Limits struct {
+	Upload       int // Everything sent
+	Download     int // Everything received
+	FileUpload   int // Each upload
+	FileDownload int // Each download, enforced by the sender
+}
+
+var (
+	limits      Limits
+	limitsMutex sync.Mutex
+
+	uploadLimiter   = rate.NewLimiter(rate.Inf, LimitBurst)
+	downloadLimiter = rate.NewLimiter(rate.Inf, LimitBurst)
+)
+
+// rateFor converts a limit in KB/s, 0 is unlimited
+func rateFor(kbps int) rate.Limit {
+	if kbps <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(kbps * 1024)
+}
+
+func setLimits(l Limits) {
+	limitsMutex.Lock()
+	limits = l
+	limitsMutex.Unlock()
+	uploadLimiter.SetLimit(rateFor(l.Upload))
+	downloadLimiter.SetLimit(rateFor(l.Download))
+}
+
+func currentLimits() Limits {
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+	return limits
+}
+
+func formatLimit(kbps int) string {
+	if kbps <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d KB/s", kbps)
+}
+
+func (l Limits) String() string {
+	return fmt.Sprintf("upload %s (per file %s), download %s (per file %s)",
+		formatLimit(l.Upload), formatLimit(l.FileUpload), formatLimit(l.Download), formatLimit(l.FileDownload))
+}
+
+// waitTokens takes n bytes worth of tokens, in bursts the bucket can hold
+func waitTokens(ctx context.Context, limiter *rate.Limiter, n int) error {
+	for n > 0 {
+		step := min(n, LimitBurst)
+		if err := limiter.WaitN(ctx, step); err != nil {
+			return err
+		}
+		n -= step
+	}
+	return nil
+}
+
+// downloadsLimited tells the sender to keep its data frames small
+func downloadsLimited() bool {
+	l := currentLimits()
+	return l.Download > 0 || l.FileDownload > 0
+}
+
+// frameSize is the data frame size of an upload
+func (t *Transfer) frameSize() int {
+	l := currentLimits()
+	if l.Upload > 0 || l.FileUpload > 0 || t.peerRate > 0 || t.peerLimited {
+		return LimitBurst
+	}
+	return ChunkSize
+}
+
+// throttle waits until the transfer may send n more bytes. peerRate is the
+// per file limit the receiver asked for, in bytes per second
+func (t *Transfer) throttle(ctx context.Context, n int) error {
+	limit := rateFor(currentLimits().FileUpload)
+	if t.peerRate > 0 && (limit == rate.Inf || rate.Limit(t.peerRate) < limit) {
+		limit = rate.Limit(t.peerRate)
+	}
+	if t.limiter == nil {
+		t.limiter = rate.NewLimiter(limit, LimitBurst)
+	} else if t.limiter.Limit() != limit {
+		t.limiter.SetLimit(limit)
+	}
+	return waitTokens(ctx, t.limiter, n)
+}
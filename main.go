@@ -12,15 +12,16 @@
 package main
 
 import (
-	"bufio"
-	"encoding/base64"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -39,6 +40,27 @@ var completer = readline.NewPrefixCompleter(
 	readline.PcItem("/add", readline.PcItemDynamic(filePathCompleter)),
 	readline.PcItem("/ls"),
 	readline.PcItem("/cl"),
+	readline.PcItem("/peers"),
+	readline.PcItem("/target", readline.PcItem("all")),
+	readline.PcItem("/queue"),
+	readline.PcItem("/cancel"),
+	readline.PcItem("/pause"),
+	readline.PcItem("/resume"),
+	readline.PcItem("/prio"),
+	readline.PcItem("/get", readline.PcItemDynamic(remotePathCompleter)),
+	readline.PcItem("/rls", readline.PcItemDynamic(remotePathCompleter)),
+	readline.PcItem("/conflicts", readline.PcItem("clear")),
+	readline.PcItem("/ignore",
+		readline.PcItem("add"),
+		readline.PcItem("rm"),
+		readline.PcItem("reload"),
+	),
+	readline.PcItem("/limit",
+		readline.PcItem("up"),
+		readline.PcItem("down"),
+		readline.PcItem("file-up"),
+		readline.PcItem("file-down"),
+	),
 )
 
 // File path completer
@@ -116,10 +138,12 @@ func getInput() (string, error) {
 		line, err := rl.Readline()
 		if err == readline.ErrInterrupt { // Handle Ctrl+C
 			if len(line) == 0 { // Exit if no input
+				sessions.closeAll()
 				os.Exit(1)
 			}
 			continue // Otherwise, ignore and prompt again
 		} else if err == io.EOF { // Handle Ctrl+D
+			sessions.closeAll()
 			os.Exit(1)
 		}
 		if err != nil {
@@ -169,28 +193,57 @@ type Config struct {
 	Port        int    `json:"port"`
 	Folder      string `json:"folder"`
 	Password    string `json:"password"`
-	WhitelistIP string `json:"peer_ip"` // Added whitelist IP field
+	WhitelistIP string `json:"peer_ip"`     // Added whitelist IP field
+	NodeID      string `json:"node_id"`     // Generated on first run, identifies this node to peers
+	TLS         bool   `json:"tls"`         // Encrypt the connection, host keys are pinned in known_peers
+	Sync        bool   `json:"sync"`        // Mirror the whole folder with the peer (both sides must enable it)
+	UploadRoot  string `json:"upload_root"` // Uploads keep their path relative to it, defaults to the working directory
+	MaxPeers    int    `json:"max_peers"`   // Peers a host serves at once, DefaultMaxPeers when 0
+	Trash       bool   `json:"trash"`       // Files the peer deletes or replaces by a rename go to <folder>/.p2p/trash
+	Compress    bool   `json:"compress"`    // Deflate data frames of compressible files (both sides must enable it)
+
+	// Attributes received files keep from the sender's copy: "mode", "mtime"
+	// and "owner". Mode and mtime when missing, [] for none
+	Preserve []string `json:"preserve"`
+
+	// Bandwidth limits in KB/s, 0 means unlimited
+	UploadLimit       int `json:"upload_limit"`        // Everything sent to the peers
+	DownloadLimit     int `json:"download_limit"`      // Everything received from the peers
+	FileUploadLimit   int `json:"file_upload_limit"`   // Each upload
+	FileDownloadLimit int `json:"file_download_limit"` // Each download, the sender is asked to respect it
 }
 
-// Message structure
+// Message structure, sent as the JSON payload of a control frame
 type Message struct {
-	Action    string `json:"action"`    // "upload", "notification"
-	Path      string `json:"path"`      // File path
-	Content   string `json:"content"`   // File content (base64 encoded)
-	TotalSize int64  `json:"totalSize"` // Total file size
+	Action    string      `json:"action"`              // "upload", "get", "list", "delete", "rename", "notification"
+	Path      string      `json:"path,omitempty"`      // File path
+	Target    string      `json:"target,omitempty"`    // New path ("rename")
+	Content   string      `json:"content,omitempty"`   // Notification text
+	TotalSize int64       `json:"totalSize"`           // Total file size
+	Hash      string      `json:"hash,omitempty"`      // SHA-256 of the file content
+	Base      string      `json:"base,omitempty"`      // Hash of the version last synced with the receiver ("upload")
+	Offset    int64       `json:"offset,omitempty"`    // Bytes the receiver already has ("upload-ack")
+	Delta     bool        `json:"delta,omitempty"`     // The sender can send changes only ("upload")
+	Signature *Signature  `json:"signature,omitempty"` // Blocks of the receiver's copy, for a delta upload ("upload-ack")
+	Rate      int64       `json:"rate,omitempty"`      // Bytes per second the receiver accepts for the upload ("upload-ack")
+	Limited   bool        `json:"limited,omitempty"`   // The receiver limits downloads, data frames must stay small ("upload-ack")
+	Mode      uint32      `json:"mode,omitempty"`      // Permission bits of the sender's file ("upload")
+	ModTime   int64       `json:"mtime,omitempty"`     // Modification time of the sender's file, Unix nanoseconds ("upload")
+	Owner     *FileOwner  `json:"owner,omitempty"`     // Owner of the sender's file, where the system has one ("upload")
+	Status    string      `json:"status,omitempty"`    // "ok" or "corrupt" ("upload-result"), "paused" or "cancelled" ("cancel")
+	Entries   []SyncEntry `json:"entries,omitempty"`   // Folder index ("sync-index") or directory listing ("list-result")
+	Truncated bool        `json:"truncated,omitempty"` // Entries were left out to fit in one frame ("list-result")
+	Stream    uint32      `json:"-"`                   // Stream id, carried in the frame header
 }
 
-// Add new message type for authentication
-type AuthMessage struct {
-	Password string `json:"password"`
-	Status   string `json:"status"` // "ok" or "failed"
-}
-
-// FileEntry represents a file in memory
+// FileEntry represents a file of the registry, saved in StateFile
 type FileEntry struct {
-	Path    string // Full path of the file
-	Size    int64  // Size of the file
-	Watched bool   // Whether the file is being watched
+	Path    string    `json:"path"`           // Full path of the file
+	Size    int64     `json:"size"`           // Size of the file
+	Watched bool      `json:"watched"`        // Whether the file is being watched
+	ModTime time.Time `json:"modTime"`        // Modification time when last seen, tells a rename from a new file
+	Hash    string    `json:"hash,omitempty"` // SHA-256 of the last version sent
+	SentAt  time.Time `json:"sentAt"`         // When it was last sent, zero if never
 }
 
 // FileManager manages the list of files
@@ -209,29 +262,9 @@ func removeFileEntry(filePath string) {
 		}
 	}
 	fileManager.Mutex.Unlock()
+	saveRegistry()
 }
 
-// Add new type for connection state management
-type ConnectionState struct {
-	isConnected bool
-	mutex       sync.Mutex
-}
-
-func (cs *ConnectionState) setConnected(connected bool) {
-	cs.mutex.Lock()
-	cs.isConnected = connected
-	cs.mutex.Unlock()
-}
-
-func (cs *ConnectionState) isActive() bool {
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-	return cs.isConnected
-}
-
-// Add global connection state
-var connState = ConnectionState{}
-
 // Add new types and globals for IP jailing
 type IPJail struct {
 	attempts map[string]int
@@ -249,12 +282,6 @@ var ipJail = IPJail{
 	jailed:   make(map[string]time.Time),
 }
 
-// CurrentConn holds the active network connection
-var CurrentConn net.Conn
-
-// ConnMutex guards access to CurrentConn
-var ConnMutex sync.Mutex
-
 // Add methods for IP jailing
 func (j *IPJail) incrementAttempt(ip string) int {
 	j.mutex.Lock()
@@ -283,19 +310,6 @@ func (j *IPJail) isJailed(ip string) bool {
 	return false
 }
 
-// Add new type for file assembly
-type FileAssembly struct {
-	TotalSize    int64
-	ReceivedSize int64
-	TempFile     *os.File
-}
-
-// Add map to track file assemblies
-var (
-	fileAssemblies = make(map[string]*FileAssembly)
-	assemblyMutex  sync.Mutex
-)
-
 func loadConfig() Config {
 	if _, err := os.Stat(ConfigFile); os.IsNotExist(err) {
 		defaultConfig := Config{
@@ -305,6 +319,8 @@ func loadConfig() Config {
 			Folder:      "./shared",
 			Password:    "1337",
 			WhitelistIP: "", // Empty means accept any IP
+			NodeID:      newNodeID(),
+			TLS:         true,
 		}
 		configData, _ := json.MarshalIndent(defaultConfig, "", "  ")
 		os.WriteFile(ConfigFile, configData, 0644)
@@ -322,6 +338,13 @@ func loadConfig() Config {
 		panic(err)
 	}
 
+	// Configs created by older versions have no node id yet
+	if config.NodeID == "" {
+		config.NodeID = newNodeID()
+		configData, _ := json.MarshalIndent(config, "", "  ")
+		os.WriteFile(ConfigFile, configData, 0644)
+	}
+
 	return config
 }
 
@@ -336,642 +359,692 @@ func isIPAllowed(config Config, remoteAddr string) bool {
 	return clientIP == config.WhitelistIP
 }
 
-func authenticateConnection(expectedPassword string) bool {
-	// Set a timeout for authentication
-	CurrentConn.SetDeadline(time.Now().Add(10 * time.Second))
-	defer CurrentConn.SetDeadline(time.Time{})
-
-	var authMessage AuthMessage
-	decoder := json.NewDecoder(CurrentConn)
-	if err := decoder.Decode(&authMessage); err != nil {
-		return false
-	}
-
-	// Send authentication response
-	response := AuthMessage{Status: "failed"}
-	if authMessage.Password == expectedPassword {
-		response.Status = "ok"
-	}
-	encoder := json.NewEncoder(CurrentConn)
-	encoder.Encode(response)
-
-	return authMessage.Password == expectedPassword
-}
-
 func startHost(config Config) {
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.IP, config.Port))
+	listener, err := net.Listen("tcp", net.JoinHostPort(config.IP, strconv.Itoa(config.Port)))
 	if err != nil {
 		panic(err)
 	}
 	defer listener.Close()
-	logMessage("Hosting on %s:%d. Waiting for connection...\n", config.IP, config.Port)
+
+	var cert tls.Certificate
+	if config.TLS {
+		if cert, err = loadIdentity(config); err != nil {
+			panic(err)
+		}
+	}
+
+	maxPeers := config.MaxPeers
+	if maxPeers <= 0 {
+		maxPeers = DefaultMaxPeers
+	}
+	logMessage("Hosting on %s:%d. Waiting for connections (up to %d peers)...\n", config.IP, config.Port, maxPeers)
 
 	for {
-		CurrentConn, err = listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			logMessage("Error accepting connection: %v\n", err)
 			continue
 		}
 
-		logMessage("Connection state: %v\n", connState.isActive())
-		if connState.isActive() {
-			// reject with msg if peer is already connected
-			logMessage("Peer already connected. Rejecting new connection...\n")
-			// send rejection msg to that connection
-			rejectionMessage := Message{Action: "notification", Content: "Peer already connected. Try again later."}
-			encoder := json.NewEncoder(CurrentConn)
-			encoder.Encode(rejectionMessage)
-			CurrentConn.Close()
-			continue
-		}
+		// Handshakes run on their own so a slow peer does not hold up the others
+		go admitPeer(config, conn, cert, maxPeers)
+	}
+}
 
-		// Extract IP from remote address
-		remoteAddr := CurrentConn.RemoteAddr().String()
-		clientIP := strings.Split(remoteAddr, ":")[0]
+// admitPeer checks and authenticates an incoming connection, then serves it
+// until it drops
+func admitPeer(config Config, conn net.Conn, cert tls.Certificate, maxPeers int) {
+	// Extract IP from remote address
+	remoteAddr := conn.RemoteAddr().String()
+	clientIP := strings.Split(remoteAddr, ":")[0]
 
-		// Check if IP is jailed
-		if ipJail.isJailed(clientIP) {
-			// logMessage("Connection rejected: IP %s is temporarily blocked\n", clientIP)
-			CurrentConn.Close()
-			continue
+	// Check if IP is jailed
+	if ipJail.isJailed(clientIP) {
+		// logMessage("Connection rejected: IP %s is temporarily blocked\n", clientIP)
+		conn.Close()
+		return
+	}
+
+	// Check if IP is allowed
+	if !isIPAllowed(config, remoteAddr) {
+		attempts := ipJail.incrementAttempt(clientIP)
+		remaining := MaxAttempts - attempts
+		if remaining > 0 {
+			logMessage("Connection rejected from non-whitelisted IP: %s (%d attempts remaining)\n",
+				clientIP, remaining)
+		} else {
+			logMessage("IP %s has been temporarily blocked for %v\n",
+				clientIP, JailTime)
 		}
+		conn.Close()
+		return
+	}
 
-		// Check if IP is allowed
-		if !isIPAllowed(config, remoteAddr) {
-			attempts := ipJail.incrementAttempt(clientIP)
-			remaining := MaxAttempts - attempts
-			if remaining > 0 {
-				logMessage("Connection rejected from non-whitelisted IP: %s (%d attempts remaining)\n",
-					clientIP, remaining)
-			} else {
-				logMessage("IP %s has been temporarily blocked for %v\n",
-					clientIP, JailTime)
-			}
-			CurrentConn.Close()
-			continue
+	// A peer with the other "tls" setting is told so instead of failing later
+	matched, err := matchTransport(conn, config.TLS)
+	if err != nil {
+		logMessage("Handshake with %s failed: %v\n", clientIP, err)
+		conn.Close()
+		return
+	}
+	conn = matched
+	if config.TLS {
+		tlsConn, err := serverTLS(conn, cert)
+		if err != nil {
+			logMessage("TLS handshake with %s failed: %v\n", clientIP, err)
+			conn.Close()
+			return
 		}
+		conn = tlsConn
+	}
 
-		// Authenticate the connection
-		if !authenticateConnection(config.Password) {
-			attempts := ipJail.incrementAttempt(clientIP)
-			remaining := MaxAttempts - attempts
-			if remaining > 0 {
-				logMessage("Authentication failed from %s (%d attempts remaining)\n",
-					clientIP, remaining)
-			} else {
-				logMessage("IP %s has been temporarily blocked for %v\n",
-					clientIP, JailTime)
-			}
-			CurrentConn.Close()
-			continue
+	if sessions.count() >= maxPeers {
+		// reject with msg if the host is full, the peer retries later
+		logMessage("Already serving %d peers. Rejecting %s...\n", maxPeers, clientIP)
+		rejectionMessage := HelloMessage{Protocol: ProtocolVersion, Version: VERSION, Error: "Host is full. Try again later."}
+		writeControl(conn, 0, rejectionMessage)
+		conn.Close()
+		return
+	}
+
+	// Exchange versions and capabilities before anything else
+	info, pin, err := acceptHello(conn, config)
+	if err != nil {
+		logMessage("Handshake with %s failed: %v\n", clientIP, err)
+		conn.Close()
+		return
+	}
+
+	// Authenticate the connection
+	sessionKey, ok := authenticateConnection(conn, config.Password)
+	if !ok {
+		attempts := ipJail.incrementAttempt(clientIP)
+		remaining := MaxAttempts - attempts
+		if remaining > 0 {
+			logMessage("Authentication failed from %s (%d attempts remaining)\n",
+				clientIP, remaining)
+		} else {
+			logMessage("IP %s has been temporarily blocked for %v\n",
+				clientIP, JailTime)
 		}
+		conn.Close()
+		return
+	}
 
-		// Reset attempts on successful authentication
-		ipJail.mutex.Lock()
-		delete(ipJail.attempts, clientIP)
-		ipJail.mutex.Unlock()
+	// Reset attempts on successful authentication
+	ipJail.mutex.Lock()
+	delete(ipJail.attempts, clientIP)
+	ipJail.mutex.Unlock()
 
-		logMessage("Welcome Peer IP: %s\n", CurrentConn.RemoteAddr().String())
-		connState.setConnected(true)
-		// Handle the connection in a new goroutine
-		go handleConnection(config)
+	// Only a peer that knew the password gets its key pinned
+	if err := pin.save(); err != nil {
+		logMessage("Rejecting %s: %v\n", clientIP, err)
+		conn.Close()
+		return
 	}
+
+	// Without TLS every byte from now on carries a MAC of the session key
+	if !config.TLS {
+		conn = sealConn(conn, sessionKey, true)
+	}
+	session, err := newSession(config, conn, info)
+	if err != nil {
+		logMessage("Error starting session with %s: %v\n", clientIP, err)
+		conn.Close()
+		return
+	}
+	if err := sessions.add(session, maxPeers); err != nil {
+		logMessage("Rejecting %s: %v\n", clientIP, err)
+		session.Close()
+		return
+	}
+	logMessage("Welcome Peer %s (%s)\n", session, info)
+	session.Run()
 }
 
 func connectToHost(config Config) {
-	for {
-		if connState.isActive() {
-			time.Sleep(1 * time.Second)
-			continue
+	address := net.JoinHostPort(config.IP, strconv.Itoa(config.Port))
+
+	var cert tls.Certificate
+	if config.TLS {
+		var err error
+		if cert, err = loadIdentity(config); err != nil {
+			panic(err)
 		}
+	}
 
-		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", config.IP, config.Port))
+	for {
+		conn, err := net.Dial("tcp", address)
 		if err != nil {
 			logMessage("Host not available. Retrying in 3 seconds...\n")
 			time.Sleep(3 * time.Second)
 			continue
 		}
 
-		ConnMutex.Lock()
-		CurrentConn = conn
-		ConnMutex.Unlock()
-
-		// Set connected state
-		connState.setConnected(true)
-
-		// Send authentication message
-		authMessage := AuthMessage{Password: config.Password}
-		encoder := json.NewEncoder(conn)
-		if err := encoder.Encode(authMessage); err != nil {
-			logMessage("Failed to send authentication: %v\n", err)
-			ConnMutex.Lock()
-			CurrentConn.Close()
-			CurrentConn = nil
-			ConnMutex.Unlock()
-			connState.setConnected(false)
-			continue
+		var hostPin *pendingPin
+		if config.TLS {
+			tlsConn, pin, err := clientTLS(conn, cert, address)
+			if err != nil {
+				conn.Close()
+				if errors.Is(err, errFingerprintChanged) {
+					warnFingerprintChanged(err)
+					os.Exit(1)
+				}
+				var header tls.RecordHeaderError
+				if errors.As(err, &header) {
+					// The host answered in clear, see matchTransport
+					err = fmt.Errorf("%w: host does not use TLS, set \"tls\": false", errTLSMismatch)
+				}
+				logMessage("TLS handshake failed: %v\n", err)
+				time.Sleep(5 * time.Second)
+				continue
+			}
+			conn, hostPin = tlsConn, pin
 		}
 
-		// Wait for authentication response
-		var response AuthMessage
-		decoder := json.NewDecoder(conn)
-		if err := decoder.Decode(&response); err != nil {
-			logMessage("Failed to receive authentication response: %v\n", err)
-			ConnMutex.Lock()
-			CurrentConn.Close()
-			CurrentConn = nil
-			ConnMutex.Unlock()
-			connState.setConnected(false)
+		// Exchange versions and capabilities before authenticating
+		info, err := sendHello(conn, config)
+		if err != nil {
+			logMessage("Handshake failed: %v\n", err)
+			conn.Close()
+			if errors.Is(err, errIncompatible) {
+				os.Exit(1)
+			}
 			time.Sleep(5 * time.Second)
 			continue
 		}
 
-		if response.Status != "ok" {
-			logMessage("Authentication failed: Invalid password or peer is unavailabe\n")
+		// Prove we know the password without sending it
+		sessionKey, err := authenticateWithHost(conn, config.Password)
+		if err != nil {
+			logMessage("Authentication failed: %v\n", err)
+			conn.Close()
 			// quit program if invalid password
+			if errors.Is(err, errAuthFailed) {
+				os.Exit(1)
+			}
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		// The host key is only pinned once the host proved it knows the password
+		if err := hostPin.save(); err != nil {
+			conn.Close()
+			if errors.Is(err, errFingerprintChanged) {
+				warnFingerprintChanged(err)
+				os.Exit(1)
+			}
+			logMessage("Error pinning host: %v\n", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if !config.TLS {
+			conn = sealConn(conn, sessionKey, false)
+		}
 
+		session, err := newSession(config, conn, info)
+		if err != nil {
+			logMessage("Error starting session: %v\n", err)
 			conn.Close()
-			connState.setConnected(false)
-			os.Exit(1)
+			time.Sleep(5 * time.Second)
+			continue
 		}
 
-		logMessage("Connected and authenticated to host.\n")
-		handleConnection(config)
+		// A peer node only talks to its host, there is no limit to check
+		sessions.add(session, 0)
+		logMessage("Connected and authenticated to host (%s).\n", info)
+		session.Run()
 
-		// Reset connection state after disconnection
-		connState.setConnected(false)
 		time.Sleep(1 * time.Second) // Add delay before reconnection attempt
 	}
 }
 
 var fileManager = FileManager{}
 
-func handleConnection(config Config) {
-	defer func() {
-		logMessage("Peer disconnected.[0]\n")
-		CurrentConn.Close()
-		connState.setConnected(false)
-		ConnMutex.Lock()
-		CurrentConn = nil
-		ConnMutex.Unlock()
-	}()
-
-	quit := make(chan bool)
-
-	sendMessage(Message{Action: "notification", Content: "Connected!"})
-
-	receivedFiles := make(map[string]bool)
-	var receivedFilesMutex sync.Mutex
+// runConsole reads commands for the whole lifetime of the program, whatever
+// peers come and go
+func runConsole(config Config, watcher *fsnotify.Watcher) {
+	for {
+		command, err := getInput()
+		if err != nil {
+			logMessage("error getting input: %v\n", err)
+			os.Exit(1)
+			return
+		}
 
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		logMessage("Error creating watcher: %v\n", err)
-		return
-	}
-	defer watcher.Close()
+		cmd, argument := parseCommand(command)
 
-	go func() {
-		reader := bufio.NewReader(CurrentConn)
-		for {
-			select {
-			case <-quit:
-				logMessage("Quit go routine 1\n")
-				return
-			default:
-				message, err := readMessage(reader)
-				if err != nil {
-					if err == io.EOF {
-						logMessage("Peer disconnected.[1]\n")
-						quit <- true
+		if cmd == "" {
+			continue
+		}
 
-						return
-					} else {
-						logMessage("Error reading message: %v\n", err)
-					}
-					return
+		switch cmd {
+		case "/up":
+			if argument == "" {
+				logMessage("Usage: /up <file|dir> or /up #<number>\n")
+				continue
+			}
+			filePath := argument
+			if strings.HasPrefix(filePath, "#") {
+				index := parseIndex(filePath)
+				if index == -1 {
+					logMessage("Invalid index.\n")
+					continue
 				}
-
-				switch message.Action {
-				case "upload":
-					filePath := filepath.Join(config.Folder, message.Path)
-					os.MkdirAll(filepath.Dir(filePath), 0755)
-
-					content, err := base64.StdEncoding.DecodeString(message.Content)
+				fileManager.Mutex.Lock()
+				if index >= len(fileManager.Files) {
+					logMessage("Index out of range.\n")
+					fileManager.Mutex.Unlock()
+					continue
+				}
+				filePath = fileManager.Files[index].Path
+				fileManager.Mutex.Unlock()
+			} else {
+				fileManager.Mutex.Lock()
+				if !fileManager.contains(filePath) {
+					fileInfo, err := os.Stat(filePath)
 					if err != nil {
-						logMessage("Error decoding content: %v\n", err)
-						continue
-					}
-
-					assemblyMutex.Lock()
-					assembly, exists := fileAssemblies[filePath]
-					if !exists {
-						tempFile, err := os.CreateTemp("", "upload-*")
-						if err != nil {
-							assemblyMutex.Unlock()
-							logMessage("Error creating temp file: %v\n", err)
-							continue
-						}
-						assembly = &FileAssembly{
-							TotalSize: message.TotalSize,
-							TempFile:  tempFile,
-						}
-						fileAssemblies[filePath] = assembly
-					}
-					assemblyMutex.Unlock()
-
-					if _, err := assembly.TempFile.Write(content); err != nil {
-						logMessage("Error writing chunk: %v\n", err)
+						logMessage("Error accessing file: %v\n", err)
+						fileManager.Mutex.Unlock()
 						continue
 					}
-
-					assembly.ReceivedSize += int64(len(content))
-
-					mb := struct {
-						Received float64
-						Total    float64
-					}{
-						Received: float64(assembly.ReceivedSize) / (1024 * 1024),
-						Total:    float64(assembly.TotalSize) / (1024 * 1024),
-					}
-
-					fmt.Printf("\r📥 Down %s: %.2f/%.2f Mb (%d%%)",
-						message.Path,
-						mb.Received,
-						mb.Total,
-						(assembly.ReceivedSize*100)/assembly.TotalSize,
-					)
-
-					if assembly.ReceivedSize >= assembly.TotalSize {
-						assembly.TempFile.Close()
-						if err := os.Rename(assembly.TempFile.Name(), filePath); err != nil {
-							logMessage("\nError saving file: %v\n", err)
-							os.Remove(assembly.TempFile.Name())
-						} else {
-							fmt.Println()
-							logMessage("File saved: %s [%d B]\n", filePath, assembly.TotalSize)
-						}
-
-						assemblyMutex.Lock()
-						delete(fileAssemblies, filePath)
-						assemblyMutex.Unlock()
-
-						receivedFilesMutex.Lock()
-						receivedFiles[filePath] = true
-						receivedFilesMutex.Unlock()
-
-						go func() {
-							time.Sleep(2 * time.Second)
-							receivedFilesMutex.Lock()
-							delete(receivedFiles, filePath)
-							receivedFilesMutex.Unlock()
-						}()
-					}
-
-				case "notification":
-					logMessage("Notification from peer: %s\n", message.Content)
+					fileManager.Files = append(fileManager.Files, FileEntry{
+						Path:    filePath,
+						Size:    fileInfo.Size(),
+						Watched: false,
+					})
+					logMessage("Added file: %s\n", filePath)
 				}
+				fileManager.Mutex.Unlock()
+				saveRegistry()
 			}
-		}
-	}()
-
-	go func() {
-		for {
-			select {
-			case <-quit:
-				return
-			default:
-
-				command, err := getInput()
+			// Uploads run in the background, the prompt stays usable and
+			// several of them share the connection
+			go func(filePath string) {
+				err := fanOut(func(session *Session) error {
+					return uploadPath(config, session, filePath)
+				})
 				if err != nil {
-					logMessage("error getting input: %v\n", err)
-					os.Exit(1)
-					return
+					logMessage("Error uploading file: %v\n", err)
+					removeFileEntry(filePath)
+				} else {
+					logMessage("File uploaded successfully!\n")
 				}
+			}(filePath)
 
-				cmd, argument := parseCommand(command)
-
-				if cmd == "" {
+		case "/w":
+			if argument == "" {
+				logMessage("Usage: /w <file|dir|pattern> or /w #<number>\n")
+				continue
+			}
+			filePath := argument
+			if info, err := os.Stat(filePath); isGlob(filePath) || (err == nil && info.IsDir()) {
+				count, err := watchPath(watcher, filePath)
+				if err != nil {
+					logMessage("Error watching %s: %v\n", filePath, err)
 					continue
 				}
-
-				switch cmd {
-				case "/up":
-					if argument == "" {
-						logMessage("Usage: /up <file> or /up #<number>\n")
-						continue
-					}
-					filePath := argument
-					if strings.HasPrefix(filePath, "#") {
-						index := parseIndex(filePath)
-						if index == -1 {
-							logMessage("Invalid index.\n")
-							continue
-						}
-						fileManager.Mutex.Lock()
-						if index >= len(fileManager.Files) {
-							logMessage("Index out of range.\n")
-							fileManager.Mutex.Unlock()
-							continue
-						}
-						filePath = fileManager.Files[index].Path
-						fileManager.Mutex.Unlock()
-					} else {
-						fileManager.Mutex.Lock()
-						if !fileManager.contains(filePath) {
-							fileInfo, err := os.Stat(filePath)
-							if err != nil {
-								logMessage("Error accessing file: %v\n", err)
-								fileManager.Mutex.Unlock()
-								continue
-							}
-							fileManager.Files = append(fileManager.Files, FileEntry{
-								Path:    filePath,
-								Size:    fileInfo.Size(),
-								Watched: false,
-							})
-							logMessage("Added file: %s\n", filePath)
-						}
-						fileManager.Mutex.Unlock()
-					}
-					if err := sendFileWithProgress(filePath); err != nil {
-						logMessage("Error uploading file: %v\n", err)
-						removeFileEntry(filePath)
-					} else {
-						logMessage("File uploaded successfully!\n")
-					}
-
-				case "/w":
-					if argument == "" {
-						logMessage("Usage: /w <file> or /w #<number>\n")
-						continue
-					}
-					filePath := argument
-					if strings.HasPrefix(filePath, "#") {
-						index := parseIndex(filePath)
-						if index == -1 {
-							logMessage("Invalid index.\n")
-							continue
-						}
-						fileManager.Mutex.Lock()
-						if index >= len(fileManager.Files) {
-							logMessage("Index out of range.\n")
-							fileManager.Mutex.Unlock()
-							continue
-						}
-						filePath = fileManager.Files[index].Path
-						fileManager.Mutex.Unlock()
-					} else {
-						fileManager.Mutex.Lock()
-						if !fileManager.contains(filePath) {
-							fileInfo, err := os.Stat(filePath)
-							if err != nil {
-								logMessage("Error accessing file: %v\n", err)
-								fileManager.Mutex.Unlock()
-								continue
-							}
-							fileManager.Files = append(fileManager.Files, FileEntry{
-								Path:    filePath,
-								Size:    fileInfo.Size(),
-								Watched: false,
-							})
-							logMessage("Added file: %s\n", filePath)
-						}
-						fileManager.Mutex.Unlock()
-					}
-					if err := watcher.Add(filePath); err != nil {
-						watcher, err = fsnotify.NewWatcher()
-						logMessage("Creating new watcher...\n")
-						if err != nil {
-							logMessage("Error creating watcher: %v\n", err)
-							continue
-						}
-					}
-					logMessage("🕵️ Now watching: %s\n", filePath)
-					fileManager.Mutex.Lock()
-					for i := range fileManager.Files {
-						if fileManager.Files[i].Path == filePath {
-							fileManager.Files[i].Watched = true
-							break
-						}
-					}
+				saveRegistry()
+				logMessage("🕵️ Now watching: %s (%d file(s), new ones are sent as they appear)\n", filePath, count)
+				continue
+			}
+			if strings.HasPrefix(filePath, "#") {
+				index := parseIndex(filePath)
+				if index == -1 {
+					logMessage("Invalid index.\n")
+					continue
+				}
+				fileManager.Mutex.Lock()
+				if index >= len(fileManager.Files) {
+					logMessage("Index out of range.\n")
 					fileManager.Mutex.Unlock()
-
-				case "/woff":
-					if argument == "" {
-						logMessage("Usage: /woff <file> or /woff #<number>\n")
-						continue
-					}
-					filePath := argument
-					if strings.HasPrefix(filePath, "#") {
-						index := parseIndex(filePath)
-						if index == -1 {
-							logMessage("Invalid index.\n")
-							continue
-						}
-						fileManager.Mutex.Lock()
-						if index >= len(fileManager.Files) {
-							logMessage("Index out of range.\n")
-							fileManager.Mutex.Unlock()
-							continue
-						}
-						filePath = fileManager.Files[index].Path
-						fileManager.Mutex.Unlock()
-					}
-					if err := watcher.Remove(filePath); err != nil {
-						logMessage("Error unwatching file: %v\n", err)
-					} else {
-						logMessage("Stopped watching: %s\n", filePath)
-						fileManager.Mutex.Lock()
-						for i := range fileManager.Files {
-							if fileManager.Files[i].Path == filePath {
-								fileManager.Files[i].Watched = false
-								break
-							}
-						}
-						fileManager.Mutex.Unlock()
-					}
-
-				case "/add":
-					if argument == "" {
-						logMessage("Usage: /add <file>\n")
-						continue
-					}
-					filePath := argument
+					continue
+				}
+				filePath = fileManager.Files[index].Path
+				fileManager.Mutex.Unlock()
+			} else {
+				fileManager.Mutex.Lock()
+				if !fileManager.contains(filePath) {
 					fileInfo, err := os.Stat(filePath)
 					if err != nil {
 						logMessage("Error accessing file: %v\n", err)
+						fileManager.Mutex.Unlock()
 						continue
 					}
-					fileManager.Mutex.Lock()
 					fileManager.Files = append(fileManager.Files, FileEntry{
 						Path:    filePath,
 						Size:    fileInfo.Size(),
 						Watched: false,
 					})
-					fileManager.Mutex.Unlock()
 					logMessage("Added file: %s\n", filePath)
-
-				case "/ls":
-					fileManager.Mutex.Lock()
-					logMessage("Index | Watched | Size | Path\n")
-					for i, file := range fileManager.Files {
-						watchedStatus := "NO"
-						if file.Watched {
-							watchedStatus = "YES"
-						}
-						logMessage("%5d | %7s | %4d | %s\n", i, watchedStatus, file.Size, file.Path)
-					}
-					fileManager.Mutex.Unlock()
-
-				case "/cl":
-					clearConsole()
-
-				default:
-					logMessage(`
-Unknown command. 
-Available commands:
-	- /add                       Add a file to the alias list
-	- /ls                        List files ready to be uploaded
-	- /cl                        Clear the console
-	- /up <file> or #<number>    Upload a file
-	- /w <file> or #<number>     Watch a file
-	- /woff <file> or #<number>  Cancel watch for a file
-`)
 				}
+				fileManager.Mutex.Unlock()
+				saveRegistry()
 			}
-		}
-	}()
+			if err := watchFile(watcher, filePath); err != nil {
+				logMessage("Error watching file: %v\n", err)
+				continue
+			}
+			saveRegistry()
+			logMessage("🕵️ Now watching: %s\n", filePath)
 
-	var (
-		lastEventTime time.Time
-		debounceDelay = 500 * time.Millisecond
-	)
-	for {
-		select {
-		case <-quit:
-			return
-		case event := <-watcher.Events:
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				filePath := event.Name
-
-				// Check if the file was received from the peer
-				receivedFilesMutex.Lock()
-				if receivedFiles[filePath] {
-					receivedFilesMutex.Unlock()
-					continue // Ignore changes to received files
+		case "/woff":
+			if argument == "" {
+				logMessage("Usage: /woff <file|dir|pattern> or /woff #<number>\n")
+				continue
+			}
+			filePath := argument
+			if err := unwatchPath(watcher, filePath); err == nil {
+				saveRegistry()
+				logMessage("Stopped watching: %s\n", filePath)
+				continue
+			}
+			if strings.HasPrefix(filePath, "#") {
+				index := parseIndex(filePath)
+				if index == -1 {
+					logMessage("Invalid index.\n")
+					continue
 				}
-				receivedFilesMutex.Unlock()
-
-				if time.Since(lastEventTime) < debounceDelay {
+				fileManager.Mutex.Lock()
+				if index >= len(fileManager.Files) {
+					logMessage("Index out of range.\n")
+					fileManager.Mutex.Unlock()
 					continue
 				}
-				lastEventTime = time.Now()
+				filePath = fileManager.Files[index].Path
+				fileManager.Mutex.Unlock()
+			}
+			if err := unwatchFile(watcher, filePath); err != nil {
+				logMessage("Error unwatching file: %v\n", err)
+			} else {
+				saveRegistry()
+				logMessage("Stopped watching: %s\n", filePath)
+			}
 
-				// Ensure the file is fully written before uploading
-				time.Sleep(100 * time.Millisecond) // Small delay to allow file write to complete
+		case "/add":
+			if argument == "" {
+				logMessage("Usage: /add <file>\n")
+				continue
+			}
+			filePath := argument
+			fileInfo, err := os.Stat(filePath)
+			if err != nil {
+				logMessage("Error accessing file: %v\n", err)
+				continue
+			}
+			fileManager.Mutex.Lock()
+			fileManager.Files = append(fileManager.Files, FileEntry{
+				Path:    filePath,
+				Size:    fileInfo.Size(),
+				Watched: false,
+			})
+			fileManager.Mutex.Unlock()
+			saveRegistry()
+			logMessage("Added file: %s\n", filePath)
+
+		case "/ls":
+			fileManager.Mutex.Lock()
+			logMessage("Index | Watched | Size | Last sent           | Path\n")
+			for i, file := range fileManager.Files {
+				watchedStatus := "NO"
+				if file.Watched {
+					watchedStatus = "YES"
+				}
+				sent := "-"
+				if !file.SentAt.IsZero() {
+					sent = file.SentAt.Format("2006-01-02 15:04:05")
+				}
+				logMessage("%5d | %7s | %4d | %-19s | %s\n", i, watchedStatus, file.Size, sent, file.Path)
+			}
+			fileManager.Mutex.Unlock()
 
-				// Check file size before uploading
-				fileInfo, err := os.Stat(filePath)
-				if err != nil {
-					logMessage("Error getting file info: %v\n", err)
-					continue
+		case "/peers":
+			list := sessions.list()
+			if len(list) == 0 {
+				logMessage("No peer connected.\n")
+				continue
+			}
+			logMessage("   ID | Target | Address               | Peer\n")
+			for _, session := range list {
+				target := "NO"
+				if sessions.isTarget(session.ID) {
+					target = "YES"
 				}
+				logMessage("%5d | %6s | %-21s | %s\n", session.ID, target, session.RemoteAddr(), session.Info)
+			}
 
-				if fileInfo.Size() == 0 {
-					logMessage("File is empty, skipping upload: %s\n", filePath)
+		case "/target":
+			if argument == "" {
+				logMessage("Usage: /target all or /target <id> [id...]\n")
+				continue
+			}
+			var ids []int
+			if argument != "all" {
+				valid := true
+				for _, field := range strings.Fields(argument) {
+					id, err := strconv.Atoi(strings.TrimPrefix(field, "#"))
+					if err != nil {
+						logMessage("Invalid peer id: %s\n", field)
+						valid = false
+						break
+					}
+					ids = append(ids, id)
+				}
+				if !valid {
 					continue
 				}
+			}
+			if err := sessions.setTargets(ids); err != nil {
+				logMessage("Error selecting peers: %v\n", err)
+				continue
+			}
+			if len(ids) == 0 {
+				logMessage("Uploads now go to every connected peer\n")
+			} else {
+				logMessage("Uploads now go to peer(s) %v\n", ids)
+			}
 
-				if err := sendFileWithProgress(filePath); err != nil {
-					logMessage("Error uploading file: %v\n", err)
-				} else {
-					logMessage("File uploaded automatically: %s\n", filePath)
+		case "/queue":
+			list := transfers.list()
+			if len(list) == 0 {
+				logMessage("No transfer queued.\n")
+				continue
+			}
+			logMessage("   ID | State     | Prio | Peer | Progress            | Path\n")
+			for _, transfer := range list {
+				progress := "-"
+				if transfer.Size > 0 {
+					progress = fmt.Sprintf("%d/%d B", transfer.Sent, transfer.Size)
 				}
+				logMessage("%5d | %-9s | %4d | %4d | %-19s | %s\n", transfer.ID, transfer.State,
+					transfer.Priority, transfer.Session.ID, progress, transfer.Local)
 			}
-		case err := <-watcher.Errors:
-			logMessage("Watcher error: %v\n", err)
-		}
-	}
-}
-
-func sendFileWithProgress(filePath string) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return err
-	}
-	totalSize := fileInfo.Size()
-	sentBytes := int64(0)
-
-	// Use smaller chunks to avoid base64 overhead
-	buffer := make([]byte, 1024*1024) // 1MB chunks
+		case "/cancel", "/pause", "/resume":
+			id, err := strconv.Atoi(strings.TrimPrefix(argument, "#"))
+			if err != nil {
+				logMessage("Usage: %s <transfer id>\n", cmd)
+				continue
+			}
+			switch cmd {
+			case "/cancel":
+				err = transfers.cancel(id)
+			case "/pause":
+				err = transfers.pause(id)
+			case "/resume":
+				err = transfers.resume(id)
+			}
+			if err != nil {
+				logMessage("Error: %v\n", err)
+			}
 
-	for sentBytes < totalSize {
-		n, err := file.Read(buffer)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("read error: %v", err)
-		}
-		if n == 0 {
-			break
-		}
+		case "/prio":
+			var id, priority int
+			if _, err := fmt.Sscanf(argument, "%d %d", &id, &priority); err != nil {
+				logMessage("Usage: /prio <transfer id> <priority> (higher runs first)\n")
+				continue
+			}
+			if err := transfers.setPriority(id, priority); err != nil {
+				logMessage("Error: %v\n", err)
+			}
 
-		chunk := buffer[:n]
-		message := Message{
-			Action:    "upload",
-			Path:      filepath.Base(filePath),
-			Content:   base64.StdEncoding.EncodeToString(chunk),
-			TotalSize: totalSize,
-		}
+		case "/get":
+			if argument == "" {
+				logMessage("Usage: /get <remote path>\n")
+				continue
+			}
+			session, err := pullTarget()
+			if err != nil {
+				logMessage("Error: %v\n", err)
+				continue
+			}
+			go func(remotePath string) {
+				if err := requestFile(session, remotePath); err != nil {
+					logMessage("Error downloading file: %v\n", err)
+				}
+			}(argument)
 
-		if err := sendMessage(message); err != nil {
-			return fmt.Errorf("send error at %d/%d bytes: %v", sentBytes, totalSize, err)
-		}
+		case "/rls":
+			session, err := pullTarget()
+			if err != nil {
+				logMessage("Error: %v\n", err)
+				continue
+			}
+			entries, truncated, err := requestListing(session, argument, ReplyTimeout)
+			if err != nil {
+				logMessage("Error listing remote folder: %v\n", err)
+				continue
+			}
+			logMessage("Type |       Size | Modified            | Hash         | Path\n")
+			for _, entry := range entries {
+				kind, size, hash := "file", fmt.Sprintf("%d", entry.Size), "-"
+				if entry.Dir {
+					kind, size = "dir", "-"
+				}
+				if entry.Hash != "" {
+					// The listing comes from the peer, the hash may be short
+					hash = entry.Hash[:min(len(entry.Hash), 12)]
+				}
+				modified := time.Unix(0, entry.ModTime).Format("2006-01-02 15:04:05")
+				logMessage("%4s | %10s | %s | %-12s | %s\n", kind, size, modified, hash, entry.Path)
+			}
+			if truncated {
+				logMessage("Listing truncated to %d entries, list a subdirectory to see the rest\n", len(entries))
+			}
 
-		sentBytes += int64(n)
-		mb := struct {
-			Sent  float64
-			Total float64
-		}{
-			Sent:  float64(sentBytes) / (1024 * 1024),
-			Total: float64(totalSize) / (1024 * 1024),
-		}
-		fmt.Printf("\r📤 Up: %.2f/%.2f mb (%d%%)", mb.Sent, mb.Total, (sentBytes*100)/totalSize)
-	}
+		case "/conflicts":
+			if argument == "clear" {
+				clearConflicts()
+				logMessage("Conflict list cleared.\n")
+				continue
+			}
+			list := listConflicts()
+			if len(list) == 0 {
+				logMessage("No conflict.\n")
+				continue
+			}
+			logMessage("Time                | Peer                     | Path -> Their version\n")
+			for _, conflict := range list {
+				logMessage("%s | %-24s | %s -> %s\n", conflict.Time.Format("2006-01-02 15:04:05"),
+					conflict.Peer, conflict.Path, conflict.SavedAs)
+			}
 
-	if sentBytes != totalSize {
-		return fmt.Errorf("incomplete transfer: sent %d/%d bytes", sentBytes, totalSize)
-	}
-	fmt.Println()
-	logMessage("File transfer completed: %s (%d bytes)\n", filepath.Base(filePath), totalSize)
-	return nil
-}
+		case "/ignore":
+			action, pattern, _ := strings.Cut(argument, " ")
+			pattern = strings.TrimSpace(pattern)
+			switch {
+			case action == "":
+				rules := listIgnoreRules()
+				if len(rules) == 0 {
+					logMessage("No ignore rule (add some with /ignore add <pattern> or in %s).\n", IgnoreFile)
+					continue
+				}
+				logMessage("Index | Rule\n")
+				for i, rule := range rules {
+					logMessage("%5d | %s\n", i, rule)
+				}
+			case action == "add" && pattern != "":
+				if err := addIgnoreRule(pattern); err != nil {
+					logMessage("Error: %v\n", err)
+					continue
+				}
+				logMessage("Ignoring: %s\n", pattern)
+			case action == "rm" && pattern != "":
+				var index int
+				if _, err := fmt.Sscanf(pattern, "%d", &index); err != nil {
+					logMessage("Usage: /ignore rm <index>\n")
+					continue
+				}
+				rule, err := removeIgnoreRule(index)
+				if err != nil {
+					logMessage("Error: %v\n", err)
+					continue
+				}
+				logMessage("Removed ignore rule: %s\n", rule)
+			case action == "reload":
+				if err := loadIgnoreRules(); err != nil {
+					logMessage("Error reading %s: %v\n", IgnoreFile, err)
+					continue
+				}
+				logMessage("Loaded %d ignore rule(s) from %s\n", len(listIgnoreRules()), IgnoreFile)
+			default:
+				logMessage("Usage: /ignore [add <pattern> | rm <index> | reload]\n")
+			}
 
-func sendMessage(message Message) error {
-	data, err := json.Marshal(message)
-	if err != nil {
-		return err
-	}
-	_, err = CurrentConn.Write(append(data, '\n'))
-	return err
-}
+		case "/limit":
+			if argument == "" {
+				logMessage("Limits: %s\n", currentLimits())
+				continue
+			}
+			var which string
+			var kbps int
+			if _, err := fmt.Sscanf(argument, "%s %d", &which, &kbps); err != nil || kbps < 0 {
+				logMessage("Usage: /limit [up|down|file-up|file-down <KB/s>] (0 for unlimited)\n")
+				continue
+			}
+			l := currentLimits()
+			switch which {
+			case "up":
+				l.Upload = kbps
+			case "down":
+				l.Download = kbps
+			case "file-up":
+				l.FileUpload = kbps
+			case "file-down":
+				l.FileDownload = kbps
+			default:
+				logMessage("Unknown limit: %s (up, down, file-up or file-down)\n", which)
+				continue
+			}
+			setLimits(l)
+			logMessage("Limits: %s\n", l)
 
-func readMessage(reader *bufio.Reader) (Message, error) {
-	data, err := reader.ReadString('\n')
-	if err != nil {
-		return Message{}, err
-	}
+		case "/cl":
+			clearConsole()
 
-	var message Message
-	if err := json.Unmarshal([]byte(data), &message); err != nil {
-		return Message{}, err
+		default:
+			logMessage(`
+Unknown command.
+Available commands:
+	- /add                          Add a file to the alias list
+	- /ls                           List files ready to be uploaded
+	- /cl                           Clear the console
+	- /up <file|dir> or #<number>   Upload a file or a directory
+	- /w <file|dir|pattern> or #<n> Watch a file, a directory or a glob pattern
+	- /woff <file|dir|pattern>      Cancel a watch (or #<number>)
+	- /peers                        List connected peers
+	- /target all or <id>...        Pick the peers uploads go to
+	- /queue                        List queued, running and paused transfers
+	- /cancel <id>                  Cancel a transfer
+	- /pause <id> or /resume <id>   Pause or resume a transfer
+	- /prio <id> <n>                Change a transfer's priority (higher runs first)
+	- /get <remote path>            Download a file or a directory from the peer's folder
+	- /rls [remote path]            List a directory of the peer's folder
+	- /conflicts [clear]            List files both sides changed, or forget them
+	- /ignore [add|rm|reload]       List or edit the ignore rules of .p2pignore
+	- /limit [<which> <KB/s>]       Show or change a bandwidth limit (up, down, file-up, file-down)
+`)
+		}
 	}
-
-	return message, nil
 }
 
 func parseIndex(s string) int {
@@ -1003,7 +1076,9 @@ func clearConsole() {
 // Log messages with timestamps
 func logMessage(format string, a ...interface{}) {
 	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	fmt.Printf("[%s] "+format, append([]interface{}{timestamp}, a...)...)
+	printAboveProgress(func() {
+		fmt.Printf("[%s] "+format, append([]interface{}{timestamp}, a...)...)
+	})
 }
 
 func main() {
@@ -1012,6 +1087,30 @@ func main() {
 	if _, err := os.Stat(config.Folder); os.IsNotExist(err) {
 		os.Mkdir(config.Folder, 0755)
 	}
+	cleanupPartials(config)
+	cleanupTrash(config)
+	loadSynced(config)
+	checkPreserve(config)
+	if err := loadIgnoreRules(); err != nil {
+		logMessage("Error reading %s: %v\n", IgnoreFile, err)
+	}
+	setLimits(Limits{
+		Upload:       config.UploadLimit,
+		Download:     config.DownloadLimit,
+		FileUpload:   config.FileUploadLimit,
+		FileDownload: config.FileDownloadLimit,
+	})
+
+	// Commands and watched files outlive any single connection
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logMessage("Error creating watcher: %v\n", err)
+		os.Exit(1)
+	}
+	defer watcher.Close()
+	loadRegistry(watcher)
+	go watchFiles(config, watcher)
+	go runConsole(config, watcher)
 
 	if config.Mode == "host" {
 		startHost(config)
@@ -0,0 +1,81 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : meta.go                                                        //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 23:52:06 by aallali                                  //
+//   Updated: 2026/10/17 23:52:06 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"os"
+	"slices"
+	"time"
+)
+
+// File metadata
+//
+// "upload" carries the permission bits, the modification time and, where the
+// system has one, the numeric owner of the sender's file. Once the file is in
+// place the receiver applies the ones listed in its Config.Preserve, mode and
+// mtime when the option is missing. Owners can usually only be changed by root.
+const (
+	PreserveMode  = "mode"
+	PreserveMtime = "mtime"
+	PreserveOwner = "owner"
+)
+
+// FileOwner is the numeric owner of a file
+type FileOwner struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+// preserves reports whether received files keep an attribute of the sender's
+func preserves(config Config, attribute string) bool {
+	if config.Preserve == nil {
+		return attribute == PreserveMode || attribute == PreserveMtime
+	}
+	return slices.Contains(config.Preserve, attribute)
+}
+
+// checkPreserve warns about attributes it does not know
+func checkPreserve(config Config) {
+	for _, attribute := range config.Preserve {
+		if attribute != PreserveMode && attribute != PreserveMtime && attribute != PreserveOwner {
+			logMessage("Unknown attribute in preserve: %q (mode, mtime or owner)\n", attribute)
+		}
+	}
+}
+
+// setMeta fills the metadata fields of an "upload" from the file to send
+func setMeta(message *Message, info os.FileInfo) {
+	message.Mode = uint32(info.Mode().Perm())
+	message.ModTime = info.ModTime().UnixNano()
+	message.Owner = fileOwner(info)
+}
+
+// applyMeta gives a received file the attributes of the sender's copy,
+// failures are reported but the file stays
+func applyMeta(config Config, filePath string, assembly *FileAssembly) {
+	if assembly.Mode != 0 && preserves(config, PreserveMode) {
+		if err := os.Chmod(filePath, os.FileMode(assembly.Mode)&os.ModePerm); err != nil {
+			logMessage("Cannot set mode of %s: %v\n", filePath, err)
+		}
+	}
+	if assembly.Owner != nil && preserves(config, PreserveOwner) {
+		if err := os.Lchown(filePath, assembly.Owner.UID, assembly.Owner.GID); err != nil {
+			logMessage("Cannot set owner of %s: %v\n", filePath, err)
+		}
+	}
+	if assembly.ModTime != 0 && preserves(config, PreserveMtime) {
+		modTime := time.Unix(0, assembly.ModTime)
+		if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+			logMessage("Cannot set modification time of %s: %v\n", filePath, err)
+		}
+	}
+}
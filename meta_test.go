@@ -0,0 +1,91 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : meta_test.go                                                   //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 23:57:30 by aallali                                  //
+//   Updated: 2026/10/17 23:57:30 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestPreserves(t *testing.T) {
+	cases := []struct {
+		preserve []string
+		expected map[string]bool
+	}{
+		{nil, map[string]bool{PreserveMode: true, PreserveMtime: true, PreserveOwner: false}},
+		{[]string{}, map[string]bool{PreserveMode: false, PreserveMtime: false, PreserveOwner: false}},
+		{[]string{PreserveOwner, PreserveMtime}, map[string]bool{PreserveMode: false, PreserveMtime: true, PreserveOwner: true}},
+	}
+	for _, c := range cases {
+		for attribute, expected := range c.expected {
+			if got := preserves(Config{Preserve: c.preserve}, attribute); got != expected {
+				t.Errorf("preserve %q: %s kept %v, expected %v", c.preserve, attribute, got, expected)
+			}
+		}
+	}
+}
+
+func TestApplyMeta(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source")
+	if err := os.WriteFile(source, []byte("content"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 2, 29, 12, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(source, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message Message
+	setMeta(&message, info)
+	if runtime.GOOS != "windows" && message.Owner == nil {
+		t.Errorf("no owner sent")
+	}
+	assembly := &FileAssembly{Mode: message.Mode, ModTime: message.ModTime}
+
+	received := func(preserve []string) os.FileInfo {
+		t.Helper()
+		path := filepath.Join(dir, "received")
+		os.Remove(path)
+		if err := os.WriteFile(path, []byte("content"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		applyMeta(Config{Preserve: preserve}, path, assembly)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	kept := received(nil)
+	if !kept.ModTime().Equal(modTime) {
+		t.Errorf("modification time %v, expected %v", kept.ModTime(), modTime)
+	}
+	if runtime.GOOS != "windows" && kept.Mode().Perm() != 0640 {
+		t.Errorf("mode %v, expected %v", kept.Mode().Perm(), os.FileMode(0640))
+	}
+
+	ignored := received([]string{})
+	if ignored.ModTime().Equal(modTime) {
+		t.Errorf("modification time applied with an empty preserve")
+	}
+	if runtime.GOOS != "windows" && ignored.Mode().Perm() != 0600 {
+		t.Errorf("mode applied with an empty preserve")
+	}
+}
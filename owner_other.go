@@ -0,0 +1,21 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : owner_other.go                                                 //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 23:55:41 by aallali                                  //
+//   Updated: 2026/10/17 23:55:41 by aallali                                  //
+// ************************************************************************** //
+
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileOwner returns nil, files have no numeric owner here
+func fileOwner(info os.FileInfo) *FileOwner {
+	return nil
+}
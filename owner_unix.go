@@ -0,0 +1,28 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : owner_unix.go                                                  //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 23:55:41 by aallali                                  //
+//   Updated: 2026/10/17 23:55:41 by aallali                                  //
+// ************************************************************************** //
+
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the numeric owner of a file
+func fileOwner(info os.FileInfo) *FileOwner {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return &FileOwner{UID: int(stat.Uid), GID: int(stat.Gid)}
+}
@@ -0,0 +1,141 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : paths.go                                                       //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 16:18:40 by aallali                                  //
+//   Updated: 2026/10/17 16:18:40 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// errUnsafePath is returned for any peer supplied path that could end up
+// outside of the shared folder or clash with the local filesystem
+var errUnsafePath = errors.New("unsafe path")
+
+// MaxPathLength caps the length of paths accepted from the peer
+const MaxPathLength = 4096
+
+// Names Windows reserves for devices, with or without an extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func unsafePath(rel, reason string) error {
+	return fmt.Errorf("%w %q: %s", errUnsafePath, rel, reason)
+}
+
+// checkComponent validates one element of a slash separated path
+func checkComponent(rel, name string) error {
+	switch name {
+	case "":
+		return unsafePath(rel, "empty path element")
+	case ".", "..":
+		return unsafePath(rel, "relative path element")
+	}
+
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return unsafePath(rel, "control character")
+		}
+		if r == '\\' {
+			return unsafePath(rel, "backslash")
+		}
+		if runtime.GOOS == "windows" && strings.ContainsRune(`<>:"|?*`, r) {
+			return unsafePath(rel, "character not allowed on windows")
+		}
+	}
+
+	// Windows silently drops trailing dots and spaces, "a." would alias "a"
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return unsafePath(rel, "trailing dot or space")
+	}
+
+	stem := strings.ToUpper(strings.TrimSpace(strings.SplitN(name, ".", 2)[0]))
+	if reservedNames[stem] {
+		return unsafePath(rel, "reserved device name")
+	}
+	return nil
+}
+
+// resolvePeerPath validates a path received from the peer and returns the
+// local path it designates inside the shared folder
+func resolvePeerPath(config Config, rel string) (string, error) {
+	if rel == "" {
+		return "", unsafePath(rel, "empty path")
+	}
+	if len(rel) > MaxPathLength {
+		return "", unsafePath(rel[:64]+"...", "path too long")
+	}
+	if strings.HasPrefix(rel, "/") || filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" ||
+		(len(rel) >= 2 && rel[1] == ':') {
+		return "", unsafePath(rel, "absolute path")
+	}
+
+	parts := strings.Split(rel, "/")
+	for _, name := range parts {
+		if err := checkComponent(rel, name); err != nil {
+			return "", err
+		}
+	}
+	if parts[0] == StateDir {
+		return "", unsafePath(rel, "reserved directory")
+	}
+
+	root, err := filepath.Abs(config.Folder)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(root, filepath.FromSlash(rel))
+	if err := checkInside(root, target); err != nil {
+		return "", unsafePath(rel, err.Error())
+	}
+	return target, nil
+}
+
+// checkInside makes sure target stays below root once symlinks are resolved,
+// a link planted in the shared folder must not redirect writes elsewhere
+func checkInside(root, target string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	// The target may not exist yet, resolve its deepest existing ancestor
+	existing := target
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return errors.New("no existing ancestor")
+		}
+		existing = parent
+	}
+
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(realRoot, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errors.New("escapes the shared folder through a symlink")
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : paths_test.go                                                  //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 16:36:11 by aallali                                  //
+//   Updated: 2026/10/17 16:36:11 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolvePeerPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	folder := filepath.Join(root, "shared")
+	if err := os.MkdirAll(filepath.Join(folder, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(folder, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(folder, "docs"), filepath.Join(folder, "inside")); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{Folder: folder}
+
+	accepted := []string{
+		"a.txt",
+		"docs/a.txt",
+		"docs/new/deeper/a.txt",
+		"inside/a.txt", // A link that stays in the folder
+		".hidden",
+		"a..b",
+	}
+	for _, rel := range accepted {
+		target, err := resolvePeerPath(config, rel)
+		if err != nil {
+			t.Errorf("%q refused: %v", rel, err)
+			continue
+		}
+		if want := filepath.Join(folder, filepath.FromSlash(rel)); target != want {
+			t.Errorf("%q resolved to %s, expected %s", rel, target, want)
+		}
+	}
+
+	refused := []string{
+		"",
+		"/etc/passwd",
+		"C:/Windows/win.ini",
+		"c:relative",
+		"..",
+		"../a.txt",
+		"docs/../../a.txt",
+		"docs/./a.txt",
+		"docs//a.txt",
+		"docs/",
+		"a\\b.txt",
+		"a\x00b",
+		"a\nb",
+		"a\x7fb",
+		"trailing.",
+		"trailing ",
+		"CON",
+		"nul.txt",
+		"docs/Com1.log",
+		StateDir + "/partial/x.part",
+		"escape/a.txt",
+		"escape/new/a.txt",
+		"escape",
+		strings.Repeat("a/", MaxPathLength),
+	}
+	for _, rel := range refused {
+		if target, err := resolvePeerPath(config, rel); !errors.Is(err, errUnsafePath) {
+			t.Errorf("%q accepted as %s (%v)", rel, target, err)
+		}
+	}
+}
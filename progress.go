@@ -0,0 +1,142 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : progress.go                                                    //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 18:21:06 by aallali                                  //
+//   Updated: 2026/10/17 18:21:06 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressInterval limits how often the progress line is redrawn
+const ProgressInterval = 100 * time.Millisecond
+
+// Progress tracks one transfer. Every running transfer shares the same
+// console line, log messages are printed above it
+type Progress struct {
+	label string // Shown when the transfer is alone on the line
+	short string // Shown when transfers share the line
+	start int64  // Bytes already there when the transfer started
+	done  int64
+	total int64
+	wire  int64 // Bytes that crossed the connection, less than done-start with compression or deltas
+}
+
+var progressLine struct {
+	active []*Progress
+	drawn  time.Time // Last redraw
+	shown  bool      // The line is currently on screen
+	mutex  sync.Mutex
+}
+
+// startProgress adds a transfer to the progress line, done bytes are
+// already there (resumed uploads)
+func startProgress(label, short string, done, total int64) *Progress {
+	progress := &Progress{label: label, short: short, start: done, done: done, total: total}
+	progressLine.mutex.Lock()
+	progressLine.active = append(progressLine.active, progress)
+	drawProgress(true)
+	progressLine.mutex.Unlock()
+	return progress
+}
+
+func (p *Progress) set(done int64) {
+	progressLine.mutex.Lock()
+	p.done = done
+	drawProgress(false)
+	progressLine.mutex.Unlock()
+}
+
+// addWire accounts for a frame payload sent or received for the transfer, it
+// is a no-op on nil
+func (p *Progress) addWire(n int) {
+	if p == nil {
+		return
+	}
+	progressLine.mutex.Lock()
+	p.wire += int64(n)
+	progressLine.mutex.Unlock()
+}
+
+// ratio describes how much compression or deltas saved, "" when they did not
+func (p *Progress) ratio() string {
+	if p.wire == 0 || float64(p.done-p.start)/float64(p.wire) < 1.05 {
+		return ""
+	}
+	return fmt.Sprintf(" %.1fx", float64(p.done-p.start)/float64(p.wire))
+}
+
+// finish removes the transfer from the line, it is a no-op on nil
+func (p *Progress) finish() {
+	if p == nil {
+		return
+	}
+	progressLine.mutex.Lock()
+	defer progressLine.mutex.Unlock()
+	for i, active := range progressLine.active {
+		if active == p {
+			progressLine.active = append(progressLine.active[:i], progressLine.active[i+1:]...)
+			drawProgress(true)
+			return
+		}
+	}
+}
+
+func (p *Progress) percent() int64 {
+	if p.total == 0 {
+		return 100
+	}
+	return p.done * 100 / p.total
+}
+
+// drawProgress redraws the line, progressLine.mutex must be held
+func drawProgress(force bool) {
+	if !force && time.Since(progressLine.drawn) < ProgressInterval {
+		return
+	}
+	progressLine.drawn = time.Now()
+
+	if progressLine.shown {
+		fmt.Print("\r\033[K")
+	}
+	progressLine.shown = len(progressLine.active) > 0
+	if !progressLine.shown {
+		return
+	}
+
+	if len(progressLine.active) == 1 {
+		p := progressLine.active[0]
+		fmt.Printf("\r%s: %.2f/%.2f Mb (%d%%)%s",
+			p.label, float64(p.done)/(1024*1024), float64(p.total)/(1024*1024), p.percent(), p.ratio())
+		return
+	}
+	parts := make([]string, len(progressLine.active))
+	for i, p := range progressLine.active {
+		parts[i] = fmt.Sprintf("%s %d%%%s", p.short, p.percent(), p.ratio())
+	}
+	fmt.Print("\r" + strings.Join(parts, " | "))
+}
+
+// printAboveProgress runs write with the progress line out of the way
+func printAboveProgress(write func()) {
+	progressLine.mutex.Lock()
+	defer progressLine.mutex.Unlock()
+	if progressLine.shown {
+		fmt.Print("\r\033[K")
+		progressLine.shown = false
+	}
+	write()
+	if len(progressLine.active) > 0 {
+		drawProgress(true)
+	}
+}
@@ -0,0 +1,208 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : protocol.go                                                    //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 09:12:05 by aallali                                  //
+//   Updated: 2026/10/17 09:12:05 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// Wire format
+//
+// Every message on the connection is a frame made of a fixed 12 byte header
+// followed by the payload (all integers are big endian):
+//
+//	| version (1) | type (1) | flags (1) | reserved (1) | stream (4) | length (4) | payload |
+//
+// Control frames carry a JSON encoded Message, data frames carry raw file
+// bytes for the stream opened by a previous "upload" control message.
+// ProtocolVersion, checked in the hello exchange, covers everything else
+// (v2: slow password key and sealed cleartext connections).
+const (
+	ProtocolVersion = 2
+	FrameVersion    = 1
+	FrameHeaderSize = 12
+	MaxFrameSize    = ChunkSize + 64*1024 // a chunk plus room for future trailers
+)
+
+// FrameType tells the receiver how to interpret the payload
+type FrameType uint8
+
+const (
+	FrameControl FrameType = 1 // JSON encoded Message
+	FrameData    FrameType = 2 // Raw file chunk for a stream
+)
+
+// Frame flags
+const (
+	FlagChecksum   uint8 = 1 << 0 // Data payload ends with a CRC-32C of the chunk
+	FlagDelta      uint8 = 1 << 1 // Data payload holds delta operations instead of file bytes
+	FlagCompressed uint8 = 1 << 2 // Data payload is deflated, the checksum covers the deflated bytes
+)
+
+// ChecksumSize is the length of the CRC-32C trailer of checksummed data frames
+const ChecksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// errBadChecksum is returned for a data frame whose trailer does not match
+var errBadChecksum = errors.New("chunk checksum mismatch")
+
+// Frame is a single unit read from or written to the wire
+type Frame struct {
+	Type     FrameType
+	Flags    uint8
+	StreamID uint32
+	Payload  []byte
+}
+
+// nextStreamID hands out stream ids for outgoing uploads
+var nextStreamID uint32
+
+func newStreamID() uint32 {
+	return atomic.AddUint32(&nextStreamID, 1)
+}
+
+func writeFrame(w io.Writer, frame Frame) error {
+	if len(frame.Payload) > MaxFrameSize {
+		return fmt.Errorf("frame too large: %d bytes", len(frame.Payload))
+	}
+
+	header := make([]byte, FrameHeaderSize)
+	header[0] = FrameVersion
+	header[1] = byte(frame.Type)
+	header[2] = frame.Flags
+	binary.BigEndian.PutUint32(header[4:8], frame.StreamID)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(frame.Payload)))
+
+	// net.Buffers uses writev where available, so header and payload
+	// leave in one syscall without copying the chunk
+	buffers := net.Buffers{header, frame.Payload}
+	_, err := buffers.WriteTo(w)
+	return err
+}
+
+func readFrame(r io.Reader) (Frame, error) {
+	header := make([]byte, FrameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Frame{}, err
+	}
+
+	if header[0] != FrameVersion {
+		return Frame{}, fmt.Errorf("unsupported frame version %d (expected %d)", header[0], FrameVersion)
+	}
+
+	length := binary.BigEndian.Uint32(header[8:12])
+	if length > MaxFrameSize {
+		return Frame{}, fmt.Errorf("frame too large: %d bytes", length)
+	}
+
+	frame := Frame{
+		Type:     FrameType(header[1]),
+		Flags:    header[2],
+		StreamID: binary.BigEndian.Uint32(header[4:8]),
+		Payload:  make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	return frame, nil
+}
+
+// controlFrame encodes any JSON encodable value as a control frame
+func controlFrame(stream uint32, v interface{}) (Frame, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return Frame{}, err
+	}
+	if len(data) > MaxFrameSize {
+		return Frame{}, fmt.Errorf("frame too large: %d bytes", len(data))
+	}
+	return Frame{Type: FrameControl, StreamID: stream, Payload: data}, nil
+}
+
+// writeControl sends any JSON encodable value as a control frame
+func writeControl(w io.Writer, stream uint32, v interface{}) error {
+	frame, err := controlFrame(stream, v)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, frame)
+}
+
+// readControl reads the next frame and decodes it into v, it is used during
+// the handshake where only control frames are expected
+func readControl(r io.Reader, v interface{}) error {
+	frame, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if frame.Type != FrameControl {
+		return fmt.Errorf("unexpected frame type %d during handshake", frame.Type)
+	}
+	return json.Unmarshal(frame.Payload, v)
+}
+
+func decodeMessage(frame Frame) (Message, error) {
+	var message Message
+	if err := json.Unmarshal(frame.Payload, &message); err != nil {
+		return Message{}, err
+	}
+	message.Stream = frame.StreamID
+	return message, nil
+}
+
+// errNotConnected is returned when sending while no peer is connected
+var errNotConnected = errors.New("not connected")
+
+// sealChunk appends the checksum trailer to a chunk, the chunk's backing
+// array should have room for ChecksumSize more bytes to avoid a copy
+func sealChunk(chunk []byte) []byte {
+	return binary.BigEndian.AppendUint32(chunk, crc32.Checksum(chunk, castagnoli))
+}
+
+// openChunk returns the file bytes of a data frame, checking the trailer
+// when the frame carries one
+func openChunk(frame Frame) ([]byte, error) {
+	chunk := frame.Payload
+	if frame.Flags&FlagChecksum != 0 {
+		if len(chunk) < ChecksumSize {
+			return nil, errBadChecksum
+		}
+		split := len(chunk) - ChecksumSize
+		if crc32.Checksum(chunk[:split], castagnoli) != binary.BigEndian.Uint32(chunk[split:]) {
+			return nil, errBadChecksum
+		}
+		chunk = chunk[:split]
+	}
+	if frame.Flags&FlagCompressed != 0 {
+		return inflateChunk(chunk)
+	}
+	return chunk, nil
+}
+
+// chunkSize is the number of file bytes carried by a data frame
+func chunkSize(frame Frame) int {
+	if frame.Flags&FlagChecksum != 0 && len(frame.Payload) >= ChecksumSize {
+		return len(frame.Payload) - ChecksumSize
+	}
+	return len(frame.Payload)
+}
@@ -0,0 +1,117 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : protocol_test.go                                               //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 09:34:20 by aallali                                  //
+//   Updated: 2026/10/17 09:34:20 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []Frame{
+		{Type: FrameControl, StreamID: 0, Payload: []byte(`{"action":"notification"}`)},
+		{Type: FrameData, Flags: FlagChecksum, StreamID: 7, Payload: sealChunk([]byte("chunk"))},
+		{Type: FrameData, StreamID: 1 << 31, Payload: []byte{}},
+		{Type: FrameData, StreamID: 2, Payload: bytes.Repeat([]byte{0xab}, MaxFrameSize)},
+	}
+	var wire bytes.Buffer
+	for _, frame := range frames {
+		if err := writeFrame(&wire, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range frames {
+		frame, err := readFrame(&wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type != expected.Type || frame.Flags != expected.Flags || frame.StreamID != expected.StreamID || !bytes.Equal(frame.Payload, expected.Payload) {
+			t.Errorf("frame on stream %d changed on the way", expected.StreamID)
+		}
+	}
+	if _, err := readFrame(&wire); err != io.EOF {
+		t.Errorf("read past the last frame: %v", err)
+	}
+}
+
+func TestControlRoundTrip(t *testing.T) {
+	var wire bytes.Buffer
+	sent := Message{Action: "upload", Path: "docs/a.txt", TotalSize: 42}
+	if err := writeControl(&wire, 5, sent); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := readFrame(&wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := decodeMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Action != sent.Action || received.Path != sent.Path || received.TotalSize != sent.TotalSize || received.Stream != 5 {
+		t.Errorf("received %+v", received)
+	}
+
+	// Only control frames are expected during the handshake
+	writeFrame(&wire, Frame{Type: FrameData, Payload: []byte("{}")})
+	if err := readControl(&wire, &received); err == nil {
+		t.Errorf("data frame accepted as control")
+	}
+}
+
+func TestFrameRefused(t *testing.T) {
+	if err := writeFrame(io.Discard, Frame{Type: FrameData, Payload: make([]byte, MaxFrameSize+1)}); err == nil {
+		t.Errorf("oversized frame written")
+	}
+
+	header := func(version byte, length uint32) []byte {
+		h := make([]byte, FrameHeaderSize)
+		h[0], h[1] = version, byte(FrameData)
+		binary.BigEndian.PutUint32(h[8:12], length)
+		return h
+	}
+	cases := []struct {
+		name string
+		wire []byte
+	}{
+		{"oversized", header(FrameVersion, MaxFrameSize+1)},
+		{"huge", header(FrameVersion, 0xffffffff)},
+		{"bad version", append(header(FrameVersion+1, 1), 0)},
+		{"short header", header(FrameVersion, 1)[:5]},
+	}
+	for _, c := range cases {
+		if _, err := readFrame(bytes.NewReader(c.wire)); err == nil {
+			t.Errorf("%s: frame accepted", c.name)
+		}
+	}
+	if _, err := readFrame(bytes.NewReader(append(header(FrameVersion, 10), 1, 2, 3))); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated payload: %v", err)
+	}
+}
+
+func TestChunkChecksum(t *testing.T) {
+	frame := Frame{Type: FrameData, Flags: FlagChecksum, Payload: sealChunk([]byte("file bytes"))}
+	chunk, err := openChunk(frame)
+	if err != nil || string(chunk) != "file bytes" {
+		t.Fatalf("openChunk = %q, %v", chunk, err)
+	}
+	frame.Payload[2] ^= 1
+	if _, err := openChunk(frame); !errors.Is(err, errBadChecksum) {
+		t.Errorf("corrupted chunk: %v", err)
+	}
+	if _, err := openChunk(Frame{Type: FrameData, Flags: FlagChecksum, Payload: []byte{1}}); !errors.Is(err, errBadChecksum) {
+		t.Errorf("chunk shorter than its checksum: %v", err)
+	}
+}
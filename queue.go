@@ -0,0 +1,291 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : queue.go                                                       //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 19:02:44 by aallali                                  //
+//   Updated: 2026/10/17 19:02:44 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Every outgoing upload goes through the transfer queue. A session runs up to
+// MaxParallelUploads of them at once, highest priority first, the rest wait
+// their turn and can be paused, cancelled or moved up from the console.
+
+// TransferState is where an upload stands in the queue
+type TransferState string
+
+const (
+	TransferQueued    TransferState = "queued"
+	TransferActive    TransferState = "active"
+	TransferPaused    TransferState = "paused"
+	TransferCancelled TransferState = "cancelled"
+)
+
+var (
+	errCancelled   = errors.New("cancelled")
+	errInterrupted = errors.New("interrupted") // An active upload was paused or cancelled
+	errNoTransfer  = errors.New("no such transfer")
+)
+
+// Transfer is one upload known to the queue
+type Transfer struct {
+	ID       int
+	Session  *Session
+	Local    string // Path of the file on this node
+	Remote   string // Path inside the peer's shared folder
+	Priority int    // Higher runs first
+	State    TransferState
+	Size     int64
+	Sent     int64
+	Full     bool   // Never send a delta, set once a delta upload was rejected
+	Hash     string // Content hash of the last attempt, names the receiver's partial file
+
+	peerRate    int64         // Per file limit asked by the receiver, bytes per second
+	peerLimited bool          // The receiver limits downloads, see frameSize
+	limiter     *rate.Limiter // Per file limit, created by throttle
+
+	stop   chan struct{} // Closed to interrupt the active upload
+	stopAs TransferState // TransferPaused or TransferCancelled once stop is closed
+	result chan error    // Receives the outcome once the transfer leaves the queue
+}
+
+// TransferQueue holds the uploads that are waiting, running or paused
+type TransferQueue struct {
+	transfers []*Transfer
+	nextID    int
+	mutex     sync.Mutex
+}
+
+var transfers = TransferQueue{}
+
+// enqueue adds an upload and starts it if the session has a free slot
+func (q *TransferQueue) enqueue(session *Session, local, remote string) *Transfer {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.nextID++
+	transfer := &Transfer{
+		ID:      q.nextID,
+		Session: session,
+		Local:   local,
+		Remote:  remote,
+		State:   TransferQueued,
+		result:  make(chan error, 1),
+	}
+	q.transfers = append(q.transfers, transfer)
+	q.dispatch()
+	return transfer
+}
+
+// wait blocks until the transfer is done, failed or cancelled
+func (t *Transfer) wait() error {
+	return <-t.result
+}
+
+// dispatch starts queued uploads while their session has room, q.mutex must
+// be held
+func (q *TransferQueue) dispatch() {
+	sort.SliceStable(q.transfers, func(i, j int) bool {
+		if q.transfers[i].Priority != q.transfers[j].Priority {
+			return q.transfers[i].Priority > q.transfers[j].Priority
+		}
+		return q.transfers[i].ID < q.transfers[j].ID
+	})
+
+	active := make(map[*Session]int)
+	for _, transfer := range q.transfers {
+		if transfer.State == TransferActive {
+			active[transfer.Session]++
+		}
+	}
+	for _, transfer := range q.transfers {
+		if transfer.State != TransferQueued || active[transfer.Session] >= MaxParallelUploads {
+			continue
+		}
+		active[transfer.Session]++
+		transfer.State = TransferActive
+		transfer.stop = make(chan struct{})
+		go q.run(transfer)
+	}
+}
+
+func (q *TransferQueue) run(transfer *Transfer) {
+	err := transfer.upload()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if errors.Is(err, errInterrupted) {
+		if transfer.stopAs == TransferPaused && !transfer.Session.isClosed() {
+			transfer.State = TransferPaused
+			q.dispatch()
+			return
+		}
+		err = errCancelled
+	}
+	q.remove(transfer, err)
+	q.dispatch()
+}
+
+// remove takes a transfer out of the queue and reports err to its waiter,
+// q.mutex must be held
+func (q *TransferQueue) remove(transfer *Transfer, err error) {
+	for i, t := range q.transfers {
+		if t == transfer {
+			q.transfers = append(q.transfers[:i], q.transfers[i+1:]...)
+			break
+		}
+	}
+	transfer.result <- err
+}
+
+func (q *TransferQueue) find(id int) (*Transfer, error) {
+	for _, transfer := range q.transfers {
+		if transfer.ID == id {
+			return transfer, nil
+		}
+	}
+	return nil, fmt.Errorf("%w #%d", errNoTransfer, id)
+}
+
+// interrupt stops an active upload after its current chunk
+func (t *Transfer) interrupt(as TransferState) {
+	t.stopAs = as
+	close(t.stop)
+}
+
+// stopped reports whether the upload was asked to stop and why
+func (q *TransferQueue) stopped(transfer *Transfer) (TransferState, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	select {
+	case <-transfer.stop:
+		return transfer.stopAs, true
+	default:
+		return "", false
+	}
+}
+
+func (q *TransferQueue) cancel(id int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	transfer, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	switch transfer.State {
+	case TransferActive:
+		if transfer.stopAs == "" {
+			transfer.interrupt(TransferCancelled)
+		}
+	default:
+		q.remove(transfer, errCancelled)
+		// A paused upload has no stream left, the receiver finds its partial
+		// file by path and hash instead
+		if transfer.State == TransferPaused && transfer.Hash != "" && transfer.Session.supports(CapCancel) {
+			go transfer.Session.send(Message{
+				Action: "cancel",
+				Path:   transfer.Remote,
+				Hash:   transfer.Hash,
+				Status: string(TransferCancelled),
+			})
+		}
+	}
+	return nil
+}
+
+func (q *TransferQueue) pause(id int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	transfer, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	switch transfer.State {
+	case TransferQueued:
+		transfer.State = TransferPaused
+	case TransferActive:
+		if transfer.stopAs == "" {
+			transfer.interrupt(TransferPaused)
+		}
+	default:
+		return fmt.Errorf("transfer #%d is already %s", id, transfer.State)
+	}
+	return nil
+}
+
+func (q *TransferQueue) resume(id int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	transfer, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	if transfer.State != TransferPaused {
+		return fmt.Errorf("transfer #%d is not paused", id)
+	}
+	transfer.State = TransferQueued
+	transfer.stopAs = ""
+	q.dispatch()
+	return nil
+}
+
+// setPriority moves a transfer up or down the queue, it only matters for
+// transfers that did not start yet
+func (q *TransferQueue) setPriority(id, priority int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	transfer, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	transfer.Priority = priority
+	q.dispatch()
+	return nil
+}
+
+func (q *TransferQueue) setHash(transfer *Transfer, hash string) {
+	q.mutex.Lock()
+	transfer.Hash = hash
+	q.mutex.Unlock()
+}
+
+func (q *TransferQueue) setProgress(transfer *Transfer, sent, size int64) {
+	q.mutex.Lock()
+	transfer.Sent, transfer.Size = sent, size
+	q.mutex.Unlock()
+}
+
+// list returns a snapshot of the queue in scheduling order
+func (q *TransferQueue) list() []Transfer {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	list := make([]Transfer, len(q.transfers))
+	for i, transfer := range q.transfers {
+		list[i] = *transfer
+	}
+	return list
+}
+
+// dropSession fails the uploads still waiting for a session that ended, the
+// running ones fail on their own
+func (q *TransferQueue) dropSession(session *Session) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, transfer := range append([]*Transfer(nil), q.transfers...) {
+		if transfer.Session == session && transfer.State != TransferActive {
+			q.remove(transfer, errNotConnected)
+		}
+	}
+}
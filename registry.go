@@ -0,0 +1,133 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : registry.go                                                    //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 23:05:12 by aallali                                  //
+//   Updated: 2026/10/17 23:05:12 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// File registry
+//
+// The /add list, with its #index aliases and watched flags, is saved to
+// StateFile next to config.json every time it changes, along with the hash
+// and time each file was last sent. It is loaded back at startup and the
+// watches are armed again.
+
+// StateFile holds the file registry
+const StateFile = "state.json"
+
+// registryState is the content of StateFile
+type registryState struct {
+	Files   []FileEntry `json:"files"`
+	Watches []string    `json:"watches,omitempty"` // Directories and patterns given to /w
+}
+
+// registryMutex keeps writes of StateFile in order
+var registryMutex sync.Mutex
+
+// saveRegistry writes the registry, fileManager.Mutex must not be held
+func saveRegistry() {
+	fileManager.Mutex.Lock()
+	state := registryState{Files: append([]FileEntry{}, fileManager.Files...)}
+	fileManager.Mutex.Unlock()
+	state.Watches = listWatchRules()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		logMessage("Error saving file list: %v\n", err)
+		return
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	// Write aside then rename, a crash never leaves half a file
+	temp := StateFile + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		logMessage("Error saving file list: %v\n", err)
+		return
+	}
+	if err := os.Rename(temp, StateFile); err != nil {
+		logMessage("Error saving file list: %v\n", err)
+	}
+}
+
+// loadRegistry restores the registry saved by the last run and watches its
+// watched files again
+func loadRegistry(watcher *fsnotify.Watcher) {
+	data, err := os.ReadFile(StateFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	var state registryState
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil {
+		logMessage("Error loading file list from %s: %v\n", StateFile, err)
+		return
+	}
+
+	fileManager.Mutex.Lock()
+	fileManager.Files = state.Files
+	for i := range fileManager.Files {
+		if info, err := os.Stat(fileManager.Files[i].Path); err == nil {
+			fileManager.Files[i].Size, fileManager.Files[i].ModTime = info.Size(), info.ModTime()
+		}
+	}
+	fileManager.Mutex.Unlock()
+
+	watched := 0
+	for _, file := range state.Files {
+		if !file.Watched {
+			continue
+		}
+		if err := watchFile(watcher, file.Path); err != nil {
+			logMessage("Error watching %s again: %v\n", file.Path, err)
+			setWatched(file.Path, false)
+			continue
+		}
+		watched++
+	}
+	for _, path := range state.Watches {
+		if _, err := watchPath(watcher, path); err != nil {
+			logMessage("Error watching %s again: %v\n", path, err)
+		}
+	}
+	if len(state.Files) > 0 {
+		logMessage("Restored %d file(s) from %s, %d watched\n", len(state.Files), StateFile, watched)
+	}
+}
+
+// recordSent remembers the hash and time a registered file was last sent
+func recordSent(filePath, hash string, size int64) {
+	found := false
+	fileManager.Mutex.Lock()
+	for i := range fileManager.Files {
+		if filepath.Clean(fileManager.Files[i].Path) == filepath.Clean(filePath) {
+			fileManager.Files[i].Size = size
+			fileManager.Files[i].Hash = hash
+			fileManager.Files[i].SentAt = time.Now()
+			found = true
+			break
+		}
+	}
+	fileManager.Mutex.Unlock()
+	if found {
+		saveRegistry()
+	}
+}
@@ -0,0 +1,329 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : remote.go                                                      //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 19:41:18 by aallali                                  //
+//   Updated: 2026/10/17 23:58:12 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pulling files
+//
+// A node asks its peer for a path of the peer's shared folder with a "get"
+// message. The peer answers with "get-result" and, when it accepted, pushes
+// the file (or every file below the directory) as regular uploads, so they
+// land at the same relative path in the requester's folder. A "list" message
+// returns the entries of one remote directory with their size, mtime and hash
+// when the peer already computed it, for /rls and remote path completion.
+const (
+	MaxListBytes      = MaxFrameSize - 4*1024 // Encoded entries per "list-result", room left for the message itself
+	CompletionTimeout = 2 * time.Second       // How long tab completion waits for the peer
+	CompletionCache   = 5 * time.Second       // Remote listings are reused this long while completing
+)
+
+// errNoGet is returned when the peer's build cannot serve files
+var errNoGet = errors.New("peer does not support downloads")
+
+// pullTarget picks the session /get and /rls talk to, they work with one peer
+func pullTarget() (*Session, error) {
+	targets := sessions.selected()
+	switch {
+	case len(targets) == 0 && sessions.count() > 0:
+		return nil, errNoTarget
+	case len(targets) == 0:
+		return nil, errNotConnected
+	case len(targets) > 1:
+		return nil, errors.New("several peers selected, pick one with /target <id>")
+	}
+	if !targets[0].supports(CapGet) {
+		return nil, errNoGet
+	}
+	return targets[0], nil
+}
+
+// requestFile asks the peer to send remotePath, the transfer itself shows up
+// like any upload coming from that peer
+func requestFile(session *Session, remotePath string) error {
+	remotePath = strings.Trim(remotePath, "/")
+	stream := newStreamID()
+	reply := session.expectReply(stream)
+	defer session.cancelReply(stream)
+
+	if err := session.send(Message{Action: "get", Path: remotePath, Stream: stream}); err != nil {
+		return fmt.Errorf("send error: %v", err)
+	}
+	result, err := waitReply(reply)
+	if err != nil {
+		return err
+	}
+	if result.Status != "ok" {
+		return fmt.Errorf("%s refused by peer: %s", remotePath, result.Content)
+	}
+	logMessage("Download of %s from %s started: %s\n", remotePath, session, result.Content)
+	return nil
+}
+
+// serveGet answers a "get" from the peer and uploads what it asked for
+func (s *Session) serveGet(message Message) {
+	files, size, err := collectRequested(s.config, message.Path)
+	if err != nil {
+		logMessage("Refused download of %q by %s: %v\n", message.Path, s, err)
+		status := "failed"
+		if errors.Is(err, errUnsafePath) {
+			status = "rejected"
+		}
+		s.send(Message{Action: "get-result", Stream: message.Stream, Status: status, Content: err.Error()})
+		return
+	}
+	s.send(Message{
+		Action:    "get-result",
+		Stream:    message.Stream,
+		Status:    "ok",
+		TotalSize: size,
+		Content:   fmt.Sprintf("%d file(s), %d B", len(files), size),
+	})
+
+	sent, err := sendFiles(s, files)
+	if err != nil {
+		logMessage("Download of %s by %s interrupted: %v\n", message.Path, s, err)
+		return
+	}
+	logMessage("Sent %s to %s on request (%d/%d file(s))\n", message.Path, s, sent, len(files))
+}
+
+// collectRequested lists the files behind a path of our shared folder, with
+// their path on the wire and their total size
+func collectRequested(config Config, rel string) ([]upload, int64, error) {
+	local, err := resolvePeerPath(config, rel)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := os.Stat(local)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: no such file or directory", rel)
+	}
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return nil, 0, fmt.Errorf("%s is not a regular file", rel)
+		}
+		return []upload{{local, rel}}, info.Size(), nil
+	}
+
+	var files []upload
+	var size int64
+	err = filepath.WalkDir(local, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Unreadable entries are left out
+		}
+		if filePath != local && isIgnored(filePath, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		inner, err := filepath.Rel(local, filePath)
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		files = append(files, upload{filePath, path.Join(rel, filepath.ToSlash(inner))})
+		return nil
+	})
+	return files, size, err
+}
+
+// requestListing fetches the entries of a remote directory, "" is the root
+// of the peer's shared folder. truncated is set when the peer left entries out
+func requestListing(session *Session, dir string, timeout time.Duration) (entries []SyncEntry, truncated bool, err error) {
+	dir = strings.Trim(dir, "/")
+	stream := newStreamID()
+	reply := session.expectReply(stream)
+	defer session.cancelReply(stream)
+
+	if err := session.send(Message{Action: "list", Path: dir, Stream: stream}); err != nil {
+		return nil, false, fmt.Errorf("send error: %v", err)
+	}
+	select {
+	case result, ok := <-reply:
+		if !ok {
+			return nil, false, errNotConnected
+		}
+		if result.Status == "failed" || result.Status == "rejected" {
+			return nil, false, fmt.Errorf("%s refused by peer: %s", dir, result.Content)
+		}
+		storeListing(session, dir, result.Entries)
+		return result.Entries, result.Truncated, nil
+	case <-time.After(timeout):
+		return nil, false, fmt.Errorf("no answer from peer after %v", timeout)
+	}
+}
+
+// serveList answers a "list" from the peer. A listing that does not fit in
+// one control frame is cut and flagged, the peer is told when it cannot be sent
+func (s *Session) serveList(message Message) {
+	entries, err := listFolder(s.config, message.Path)
+	if err != nil {
+		status := "failed"
+		if errors.Is(err, errUnsafePath) {
+			status = "rejected"
+		}
+		s.send(Message{Action: "list-result", Stream: message.Stream, Status: status, Content: err.Error()})
+		return
+	}
+	entries, truncated := capListing(entries, MaxListBytes)
+	err = s.send(Message{Action: "list-result", Stream: message.Stream, Status: "done", Entries: entries, Truncated: truncated})
+	if err != nil && !errors.Is(err, errNotConnected) {
+		logMessage("Error sending listing of /%s to %s: %v\n", message.Path, s, err)
+		s.send(Message{Action: "list-result", Stream: message.Stream, Status: "failed", Content: "listing could not be sent"})
+	}
+}
+
+// capListing keeps the leading entries whose JSON encoding fits in limit
+// bytes, truncated is set when some were left out
+func capListing(entries []SyncEntry, limit int) (kept []SyncEntry, truncated bool) {
+	size := 0
+	for i, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return entries[:i], true
+		}
+		size += len(data) + 1 // the separating comma
+		if size > limit {
+			return entries[:i], true
+		}
+	}
+	return entries, false
+}
+
+// listFolder returns the entries of one directory of our shared folder
+func listFolder(config Config, dir string) ([]SyncEntry, error) {
+	dir = strings.Trim(dir, "/")
+	local := config.Folder
+	if dir != "" {
+		var err error
+		if local, err = resolvePeerPath(config, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	items, err := os.ReadDir(local)
+	if err != nil {
+		return nil, fmt.Errorf("%s: cannot read directory", dir)
+	}
+	entries := make([]SyncEntry, 0, len(items))
+	for _, item := range items {
+		if dir == "" && item.Name() == StateDir {
+			continue
+		}
+		if !item.IsDir() && !item.Type().IsRegular() {
+			continue
+		}
+		if isIgnored(filepath.Join(local, item.Name()), item.IsDir()) {
+			continue
+		}
+		info, err := item.Info()
+		if err != nil {
+			continue // vanished while listing
+		}
+		entry := SyncEntry{Path: path.Join(dir, item.Name()), ModTime: info.ModTime().UnixNano(), Dir: item.IsDir()}
+		if !entry.Dir {
+			// Hashing a whole folder on every listing is too slow, only
+			// hashes computed by uploads, downloads or sync are shared
+			entry.Size = info.Size()
+			entry.Hash = lookupHash(filepath.Join(local, item.Name()), info)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// Listings fetched by /rls or while completing, keyed by session and directory
+type cachedListing struct {
+	entries []SyncEntry
+	fetched time.Time
+}
+
+var (
+	listingCache      = make(map[string]cachedListing)
+	listingCacheMutex sync.Mutex
+)
+
+func storeListing(session *Session, dir string, entries []SyncEntry) {
+	listingCacheMutex.Lock()
+	listingCache[fmt.Sprintf("%d:%s", session.ID, dir)] = cachedListing{entries, time.Now()}
+	listingCacheMutex.Unlock()
+}
+
+func cachedRemoteListing(session *Session, dir string) ([]SyncEntry, error) {
+	listingCacheMutex.Lock()
+	cached, exists := listingCache[fmt.Sprintf("%d:%s", session.ID, dir)]
+	listingCacheMutex.Unlock()
+	if exists && time.Since(cached.fetched) < CompletionCache {
+		return cached.entries, nil
+	}
+
+	entries, _, err := requestListing(session, dir, CompletionTimeout)
+	return entries, err
+}
+
+// remotePathCompleter completes paths of the peer's shared folder
+func remotePathCompleter(line string) []string {
+	cmd, argument := parseCommand(line)
+	if cmd == "" {
+		return nil
+	}
+	session, err := pullTarget()
+	if err != nil {
+		return nil
+	}
+
+	// Same rules as local paths: a trailing slash lists the directory itself
+	dir, prefix := path.Dir(argument), path.Base(argument)
+	if argument == "" || strings.HasSuffix(argument, "/") {
+		dir, prefix = strings.TrimSuffix(argument, "/"), ""
+	}
+	if dir == "." {
+		dir = ""
+	}
+
+	entries, err := cachedRemoteListing(session, dir)
+	if err != nil {
+		return nil
+	}
+	var suggestions []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(path.Base(entry.Path), prefix) {
+			continue
+		}
+		if entry.Dir {
+			suggestions = append(suggestions, entry.Path+"/")
+		} else {
+			suggestions = append(suggestions, entry.Path)
+		}
+	}
+	return suggestions
+}
@@ -0,0 +1,126 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : seal.go                                                        //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 12:52:40 by aallali                                  //
+//   Updated: 2026/10/17 12:52:40 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Sealed connections
+//
+// Without TLS nothing would stop someone on the path from injecting frames
+// once the peers authenticated. Every byte written after authentication is
+// then cut into records that carry a MAC keyed by the session key:
+//
+//	| length (4) | data | HMAC-SHA256(key, sequence | length | data)[:16] |
+//
+// Each direction has its own key and sequence number, so a record cannot be
+// dropped, replayed, reordered or sent back. The content is not encrypted,
+// enable Config.TLS for that.
+const (
+	MaxRecordSize = 64 * 1024
+	RecordMACSize = 16
+)
+
+// errBadRecord means a record was tampered with, the connection is dropped
+var errBadRecord = errors.New("record authentication failed")
+
+type sealedConn struct {
+	net.Conn
+	sendKey, recvKey []byte
+	sendSeq, recvSeq uint64
+	writeMutex       sync.Mutex
+	record           []byte // Buffer for incoming records
+	pending          []byte // Authenticated bytes not read yet
+}
+
+// sealConn wraps an authenticated cleartext connection, host tells which
+// side of it we are
+func sealConn(conn net.Conn, sessionKey []byte, host bool) net.Conn {
+	toPeer := sealKey(sessionKey, "host->peer")
+	toHost := sealKey(sessionKey, "peer->host")
+	sealed := &sealedConn{Conn: conn, sendKey: toHost, recvKey: toPeer, record: make([]byte, MaxRecordSize+RecordMACSize)}
+	if host {
+		sealed.sendKey, sealed.recvKey = toPeer, toHost
+	}
+	return sealed
+}
+
+func sealKey(sessionKey []byte, label string) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func recordMAC(key []byte, seq uint64, header, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(binary.BigEndian.AppendUint64(nil, seq))
+	mac.Write(header)
+	mac.Write(data)
+	return mac.Sum(nil)[:RecordMACSize]
+}
+
+func (c *sealedConn) Write(p []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		data := p[:min(len(p), MaxRecordSize)]
+		header := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		buffers := net.Buffers{header, data, recordMAC(c.sendKey, c.sendSeq, header, data)}
+		if _, err := buffers.WriteTo(c.Conn); err != nil {
+			return written, err
+		}
+		c.sendSeq++
+		written += len(data)
+		p = p[len(data):]
+	}
+	return written, nil
+}
+
+// Read is only called from one goroutine at a time, the read loop
+func (c *sealedConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length > MaxRecordSize {
+			return 0, fmt.Errorf("%w: record of %d bytes", errBadRecord, length)
+		}
+		record := c.record[:int(length)+RecordMACSize]
+		if _, err := io.ReadFull(c.Conn, record); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		data := record[:length]
+		if !hmac.Equal(record[length:], recordMAC(c.recvKey, c.recvSeq, header, data)) {
+			return 0, errBadRecord
+		}
+		c.recvSeq++
+		c.pending = data
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
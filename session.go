@@ -0,0 +1,604 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : session.go                                                     //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 17:05:12 by aallali                                  //
+//   Updated: 2026/10/17 23:59:04 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	DefaultMaxPeers   = 8                // Used when Config.MaxPeers is not set
+	WriteTimeout      = 60 * time.Second // A frame that takes longer to write means the peer stopped reading
+	MaxControlBacklog = 1024             // Control frames waiting for the writer, more means the peer stopped reading
+)
+
+// errHostFull is returned when the host already serves Config.MaxPeers peers
+var errHostFull = errors.New("host is full")
+
+// errNoTarget is returned when every peer picked with /target disconnected,
+// nothing is sent to the others
+var errNoTarget = errors.New("no peer picked with /target is connected, use /target to pick others")
+
+// Session is one authenticated connection. The host runs one per connected
+// peer, a peer node only ever has one: with its host. The session owns the
+// connection and everything tied to it, Close releases all of it at once
+type Session struct {
+	ID   int      // Assigned when the session joins the SessionSet
+	Info PeerInfo // Negotiated during the hello exchange
+
+	config Config
+	conn   net.Conn
+	reader *bufio.Reader
+	ctx    context.Context
+	cancel context.CancelFunc // Cancelled on Close, releases throttled reads and writes
+
+	closed atomic.Bool // Set once the session is closed, checked without any lock
+
+	// Only writeLoop writes to conn, so headers and payloads never interleave
+	// and the read loop never waits on the wire to answer
+	control    []Frame     // Control frames waiting for the writer, sent before any chunk
+	queue      []*outChunk // Data frames waiting for their turn, at most one per stream
+	queueMutex sync.Mutex
+	queueCond  *sync.Cond
+
+	watcher   *fsnotify.Watcher // Folder sync watcher, nil unless sync was negotiated
+	done      chan struct{}     // Closed when the session ends
+	closeOnce sync.Once
+
+	assemblies    map[uint32]*FileAssembly // Incoming uploads, keyed by stream id
+	assemblyMutex sync.Mutex
+
+	replies      map[uint32]chan Message // Replies awaited by our uploads, keyed by stream id
+	repliesMutex sync.Mutex
+
+	remoteIndex      []SyncEntry // "sync-index" batches until the peer sends the last one
+	remoteIndexMutex sync.Mutex
+
+	localIndex   []SyncEntry   // Our folder as sent in "sync-index", reconcile compares it with the peer's
+	localIndexOK bool          // Whether the scan behind localIndex succeeded
+	localScanned chan struct{} // Closed once localIndex is set
+}
+
+// newSession wraps a connection that went through the handshake, any
+// net.Conn works so sessions can run over net.Pipe as well
+func newSession(config Config, conn net.Conn, info PeerInfo) (*Session, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &Session{
+		Info:         info,
+		config:       config,
+		conn:         conn,
+		reader:       bufio.NewReaderSize(conn, FrameHeaderSize+ChunkSize),
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+		assemblies:   make(map[uint32]*FileAssembly),
+		replies:      make(map[uint32]chan Message),
+		localScanned: make(chan struct{}),
+	}
+	session.queueCond = sync.NewCond(&session.queueMutex)
+	if info.supports(CapSync) {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, fmt.Errorf("creating sync watcher: %v", err)
+		}
+		session.watcher = watcher
+	}
+	return session, nil
+}
+
+func (s *Session) supports(capability string) bool {
+	return s.Info.supports(capability)
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) String() string {
+	return fmt.Sprintf("#%d %s", s.ID, s.RemoteAddr())
+}
+
+// Done is closed when the session ends
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// send queues a control frame for writeLoop and returns without waiting for
+// the wire, so the read loop can answer while a chunk is being written
+func (s *Session) send(message Message) error {
+	frame, err := controlFrame(message.Stream, message)
+	if err != nil {
+		return err
+	}
+	if s.isClosed() {
+		return errNotConnected
+	}
+
+	s.queueMutex.Lock()
+	backlog := len(s.control)
+	if backlog < MaxControlBacklog {
+		s.control = append(s.control, frame)
+		s.queueCond.Signal()
+	}
+	s.queueMutex.Unlock()
+
+	if backlog >= MaxControlBacklog {
+		logMessage("Closing %s: %d messages wait to be sent\n", s, backlog)
+		s.Close()
+		return errNotConnected
+	}
+	return nil
+}
+
+// outChunk is a data frame queued by an upload, sent reports the write result
+type outChunk struct {
+	frame Frame
+	sent  chan error
+}
+
+// sendChunk queues a data frame and waits until it is on the wire. Each
+// upload has at most one chunk queued, so serving the queue in order sends
+// one chunk of every running upload in turn and a big file never holds up
+// the small ones
+func (s *Session) sendChunk(stream uint32, flags uint8, payload []byte) error {
+	chunk := &outChunk{
+		frame: Frame{Type: FrameData, Flags: flags, StreamID: stream, Payload: payload},
+		sent:  make(chan error, 1),
+	}
+	s.queueMutex.Lock()
+	s.queue = append(s.queue, chunk)
+	s.queueCond.Signal()
+	s.queueMutex.Unlock()
+
+	select {
+	case err := <-chunk.sent:
+		return err
+	case <-s.done:
+		return errNotConnected
+	}
+}
+
+// writeLoop writes queued frames until the session ends. Control frames go
+// first and slip in between chunks, a failed write ends the session
+func (s *Session) writeLoop() {
+	for {
+		s.queueMutex.Lock()
+		for len(s.control) == 0 && len(s.queue) == 0 && !s.isClosed() {
+			s.queueCond.Wait()
+		}
+		if s.isClosed() {
+			s.queueMutex.Unlock()
+			return
+		}
+		if len(s.control) > 0 {
+			frame := s.control[0]
+			s.control = s.control[1:]
+			s.queueMutex.Unlock()
+			if err := s.write(frame); err != nil {
+				return
+			}
+			continue
+		}
+		chunk := s.queue[0]
+		s.queue = s.queue[1:]
+		s.queueMutex.Unlock()
+
+		// Waiting for the upload limit must not hold up control frames
+		if err := waitTokens(s.ctx, uploadLimiter, FrameHeaderSize+len(chunk.frame.Payload)); err != nil {
+			chunk.sent <- errNotConnected
+			continue
+		}
+		err := s.write(chunk.frame)
+		chunk.sent <- err
+		if err != nil {
+			return
+		}
+	}
+}
+
+// write puts one frame on the wire, only writeLoop calls it
+func (s *Session) write(frame Frame) error {
+	if s.isClosed() {
+		return errNotConnected
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if err := writeFrame(s.conn, frame); err != nil {
+		if !s.isClosed() {
+			logMessage("Error writing to %s: %v\n", s, err)
+			s.Close()
+		}
+		return errNotConnected
+	}
+	return nil
+}
+
+func (s *Session) isClosed() bool {
+	return s.closed.Load()
+}
+
+// Close ends the session, it is safe to call more than once and from any
+// goroutine. Waiting uploads fail with errNotConnected and partial files stay
+// on disk to be resumed
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		// The connection goes first, it fails a write that is blocked on a
+		// peer that stopped reading instead of waiting for it
+		s.closed.Store(true)
+		s.conn.Close()
+
+		close(s.done)
+		s.cancel()
+		s.queueMutex.Lock()
+		s.queueCond.Broadcast()
+		s.queueMutex.Unlock()
+		if s.watcher != nil {
+			s.watcher.Close()
+		}
+		s.failPendingReplies()
+		s.closeAssemblies()
+		transfers.dropSession(s)
+		sessions.remove(s)
+	})
+}
+
+// Run serves the session until the connection drops or Close is called
+func (s *Session) Run() {
+	defer s.Close()
+
+	s.send(Message{Action: "notification", Content: "Connected!"})
+
+	go s.writeLoop()
+	if s.watcher != nil {
+		go s.runSync()
+	}
+
+	if err := s.readLoop(); err != io.EOF && !s.isClosed() {
+		logMessage("Error reading message from %s: %v\n", s, err)
+	}
+	logMessage("Peer %s disconnected.\n", s)
+}
+
+// readLoop dispatches incoming frames until reading fails
+func (s *Session) readLoop() error {
+	for {
+		frame, err := readFrame(s.reader)
+		if err != nil {
+			return err
+		}
+
+		if frame.Type == FrameData {
+			if err := waitTokens(s.ctx, downloadLimiter, FrameHeaderSize+len(frame.Payload)); err != nil {
+				return err
+			}
+			s.handleChunk(frame)
+			continue
+		}
+
+		message, err := decodeMessage(frame)
+		if err != nil {
+			logMessage("Error decoding message: %v\n", err)
+			continue
+		}
+		s.handleMessage(message)
+	}
+}
+
+func (s *Session) handleChunk(frame Frame) {
+	assembly, exists := s.assembly(frame.StreamID)
+	if !exists {
+		logMessage("Received chunk for unknown stream %d\n", frame.StreamID)
+		return
+	}
+
+	if assembly.Failed {
+		if assembly.skip(frame) {
+			s.removeAssembly(frame.StreamID)
+		}
+		return
+	}
+
+	// A bad chunk is never written, the partial file stays valid up to
+	// ReceivedSize and the sender resumes from there
+	assembly.Progress.addWire(len(frame.Payload))
+	chunk, err := openChunk(frame)
+	if err == nil && frame.Flags&FlagDelta != 0 {
+		err = assembly.applyDelta(chunk)
+		if err != nil && !errors.Is(err, errBadDelta) {
+			logMessage("Error writing chunk: %v\n", err)
+			return
+		}
+	}
+	if err != nil {
+		logMessage("Rejected chunk of %s at %d bytes: %v\n", assembly.Name, assembly.ReceivedSize, err)
+		assembly.Failed = true
+		assembly.Progress.finish()
+		assembly.closeFiles()
+		if assembly.skip(frame) {
+			s.removeAssembly(frame.StreamID)
+		}
+		s.send(Message{Action: "upload-result", Stream: frame.StreamID, Status: "corrupt", Content: err.Error()})
+		return
+	}
+
+	if frame.Flags&FlagDelta == 0 {
+		if err := assembly.write(chunk); err != nil {
+			logMessage("Error writing chunk: %v\n", err)
+			return
+		}
+	}
+
+	if assembly.complete() {
+		s.finishAssembly(frame.StreamID, assembly)
+	}
+}
+
+func (s *Session) handleMessage(message Message) {
+	switch message.Action {
+	case "upload":
+		assembly, err := openAssembly(s.config, s, message)
+		if err != nil {
+			logMessage("Rejected upload of %q from %s: %v\n", message.Path, s, err)
+			rejectUpload(s, message, err)
+			return
+		}
+
+		s.addAssembly(message.Stream, assembly)
+
+		// Tell the sender where to start, it may already be done
+		if s.supports(CapResume) {
+			s.send(Message{
+				Action:    "upload-ack",
+				Stream:    message.Stream,
+				Offset:    assembly.ReceivedSize,
+				Signature: assembly.Signature,
+				Rate:      int64(currentLimits().FileDownload) * 1024,
+				Limited:   downloadsLimited(),
+			})
+		}
+		if assembly.complete() {
+			s.finishAssembly(message.Stream, assembly)
+		}
+
+	case "upload-ack", "upload-result", "get-result", "list-result":
+		s.deliverReply(message)
+
+	case "get", "list":
+		if !s.supports(CapGet) {
+			logMessage("Ignoring %s from %s: downloads are not enabled\n", message.Action, s)
+			return
+		}
+		if message.Action == "get" {
+			go s.serveGet(message)
+		} else {
+			s.serveList(message)
+		}
+
+	case "cancel":
+		s.cancelAssembly(message)
+
+	case "delete", "rename":
+		// Deletes also come from folder sync, builds that predate watched
+		// file deletes only send them with sync on
+		if !s.supports(CapDelete) && !(message.Action == "delete" && s.supports(CapSync)) {
+			logMessage("Ignoring %s from %s: deletes are not enabled\n", message.Action, s)
+			return
+		}
+		if message.Action == "delete" {
+			applyDelete(s.config, s, message)
+		} else {
+			applyRename(s.config, s, message)
+		}
+
+	case "sync-index", "mkdir":
+		// Folder operations are only accepted when both sides agreed to
+		// mirror their folders
+		if !s.supports(CapSync) {
+			logMessage("Ignoring %s from %s: folder sync is not enabled\n", message.Action, s)
+			return
+		}
+		switch message.Action {
+		case "sync-index":
+			if index, complete := s.receiveSyncIndex(message); complete {
+				go reconcile(s.config, s, index)
+			}
+		case "mkdir":
+			applyMkdir(s.config, s, message)
+		}
+
+	case "notification":
+		logMessage("Notification from peer %s: %s\n", s, message.Content)
+	}
+}
+
+// finishAssembly moves a completed upload into place
+func (s *Session) finishAssembly(stream uint32, assembly *FileAssembly) {
+	filePath := assembly.Path
+	s.removeAssembly(stream)
+
+	// Never move a file into place unless it matches what was sent
+	if err := assembly.verify(); err != nil {
+		logMessage("Rejected %s: %v\n", assembly.Name, err)
+		assembly.closeFiles()
+		os.Remove(assembly.TempFile.Name())
+		if s.supports(CapVerify) {
+			s.send(Message{Action: "upload-result", Stream: stream, Status: "corrupt", Content: err.Error()})
+		}
+		return
+	}
+
+	// Both sides changed the file since they last agreed on it, ours stays
+	// and theirs is saved next to it
+	conflict := detectConflict(s, assembly)
+	if conflict {
+		filePath = conflictPath(s, assembly.Path)
+	}
+
+	// Marked before the rename so the watchers never see it as a local change
+	markReceived(s, filePath)
+	assembly.closeFiles()
+	if err := os.Rename(assembly.TempFile.Name(), filePath); err != nil {
+		logMessage("Error saving file: %v\n", err)
+		os.Remove(assembly.TempFile.Name())
+		if s.supports(CapVerify) {
+			s.send(Message{Action: "upload-result", Stream: stream, Status: "failed", Content: err.Error()})
+		}
+		return
+	}
+	applyMeta(s.config, filePath, assembly)
+	if info, err := os.Stat(filePath); err == nil && assembly.Hash != "" {
+		rememberHash(filePath, info, assembly.Hash)
+	}
+	if conflict {
+		recordConflict(s, assembly.Name, filePath)
+		logMessage("⚠️ Conflict on %s: changed here and by %s, their version saved as %s\n", assembly.Name, s, filePath)
+		s.send(Message{Action: "notification", Content: fmt.Sprintf("Conflict on %s: your version was saved as %s", assembly.Name, filepath.Base(filePath))})
+	} else {
+		recordSynced(s, assembly.Name, assembly.Hash)
+		logMessage("File saved from %s: %s [%d B]\n", s, filePath, assembly.TotalSize)
+	}
+	if s.supports(CapVerify) {
+		s.send(Message{Action: "upload-result", Stream: stream, Status: "ok"})
+	}
+}
+
+// SessionSet tracks every running session and the ones commands are sent to
+type SessionSet struct {
+	sessions map[int]*Session
+	targets  map[int]bool // Sessions picked with /target
+	all      bool         // Uploads go to every session, set by "/target all"
+	nextID   int
+	mutex    sync.Mutex
+}
+
+var sessions = SessionSet{
+	sessions: make(map[int]*Session),
+	targets:  make(map[int]bool),
+	all:      true,
+}
+
+// add registers a session and gives it its id, max <= 0 means no limit
+func (ss *SessionSet) add(session *Session, max int) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if max > 0 && len(ss.sessions) >= max {
+		return fmt.Errorf("%w (%d peers)", errHostFull, max)
+	}
+	ss.nextID++
+	session.ID = ss.nextID
+	ss.sessions[session.ID] = session
+	return nil
+}
+
+func (ss *SessionSet) remove(session *Session) {
+	ss.mutex.Lock()
+	delete(ss.sessions, session.ID)
+	delete(ss.targets, session.ID)
+	ss.mutex.Unlock()
+}
+
+func (ss *SessionSet) count() int {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return len(ss.sessions)
+}
+
+// list returns the running sessions ordered by id
+func (ss *SessionSet) list() []*Session {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	list := make([]*Session, 0, len(ss.sessions))
+	for _, session := range ss.sessions {
+		list = append(list, session)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// closeAll ends every session, used when the program exits
+func (ss *SessionSet) closeAll() {
+	for _, session := range ss.list() {
+		session.Close()
+	}
+}
+
+func (ss *SessionSet) isTarget(id int) bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.all || ss.targets[id]
+}
+
+// selected returns the sessions uploads and watched files go to
+func (ss *SessionSet) selected() []*Session {
+	var selected []*Session
+	for _, session := range ss.list() {
+		if ss.isTarget(session.ID) {
+			selected = append(selected, session)
+		}
+	}
+	return selected
+}
+
+// setTargets restricts uploads to the given peers, no ids selects everyone
+func (ss *SessionSet) setTargets(ids []int) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	for _, id := range ids {
+		if _, exists := ss.sessions[id]; !exists {
+			return fmt.Errorf("no peer #%d", id)
+		}
+	}
+	ss.all = len(ids) == 0
+	ss.targets = make(map[int]bool)
+	for _, id := range ids {
+		ss.targets[id] = true
+	}
+	return nil
+}
+
+// fanOut runs send for every selected session at once and collects the errors
+func fanOut(send func(session *Session) error) error {
+	targets := sessions.selected()
+	if len(targets) == 0 {
+		if sessions.count() > 0 {
+			// The peers picked with /target left, the others were excluded
+			return errNoTarget
+		}
+		return errNotConnected
+	}
+
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, session := range targets {
+		wg.Add(1)
+		go func(i int, session *Session) {
+			defer wg.Done()
+			if err := send(session); err != nil {
+				errs[i] = fmt.Errorf("peer %s: %v", session, err)
+			}
+		}(i, session)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
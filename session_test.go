@@ -0,0 +1,219 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : session_test.go                                                //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 17:31:45 by aallali                                  //
+//   Updated: 2026/10/17 23:58:12 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeSessions connects two sessions over net.Pipe, the host shares folder
+func pipeSessions(t *testing.T, folder string) (host, peer *Session) {
+	t.Helper()
+	info := PeerInfo{NodeID: "test", Version: VERSION, Capabilities: map[string]bool{}}
+	for _, c := range []string{CapUpload, CapResume, CapVerify, CapGet} {
+		info.Capabilities[c] = true
+	}
+	hostConn, peerConn := net.Pipe()
+	host, err := newSession(Config{Mode: "host", Folder: folder}, hostConn, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err = newSession(Config{Mode: "peer", Folder: t.TempDir()}, peerConn, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go host.Run()
+	go peer.Run()
+	t.Cleanup(func() {
+		peer.Close()
+		host.Close()
+	})
+	return host, peer
+}
+
+func TestSessionUpload(t *testing.T) {
+	work := inTempDir(t)
+	folder := filepath.Join(work, "shared")
+	if err := os.Mkdir(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, peer := pipeSessions(t, folder)
+
+	content := make([]byte, 3*ChunkSize+1234)
+	rand.New(rand.NewSource(1)).Read(content)
+	local := filepath.Join(work, "big.bin")
+	if err := os.WriteFile(local, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- sendFileWithProgress(peer, local, "docs/big.bin") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("upload did not complete")
+	}
+
+	received, err := os.ReadFile(filepath.Join(folder, "docs", "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Errorf("received %d bytes that differ from the %d sent", len(received), len(content))
+	}
+
+	// A path the host refuses fails the upload instead of writing anything
+	if err := sendFileWithProgress(peer, local, "../escape.bin"); err == nil {
+		t.Errorf("upload outside of the shared folder accepted")
+	}
+	if _, err := os.Stat(filepath.Join(work, "escape.bin")); !os.IsNotExist(err) {
+		t.Errorf("file written outside of the shared folder")
+	}
+}
+
+func TestSessionTwoWayUpload(t *testing.T) {
+	work := inTempDir(t)
+	folder := filepath.Join(work, "shared")
+	if err := os.Mkdir(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	host, peer := pipeSessions(t, folder)
+
+	// Both read loops answer while their writer is busy with big chunks
+	random := rand.New(rand.NewSource(2))
+	contents := make(map[string][]byte)
+	destinations := make(map[string]string)
+	done := make(chan error, 2*MaxParallelUploads)
+	for i := 0; i < MaxParallelUploads; i++ {
+		for _, sender := range []*Session{peer, host} {
+			name := fmt.Sprintf("%s-%d.bin", sender.config.Mode, i)
+			contents[name] = make([]byte, 2*ChunkSize+random.Intn(ChunkSize))
+			random.Read(contents[name])
+			if err := os.WriteFile(filepath.Join(work, name), contents[name], 0644); err != nil {
+				t.Fatal(err)
+			}
+			destinations[name] = folder
+			if sender == host {
+				destinations[name] = peer.config.Folder
+			}
+			go func(sender *Session, name string) {
+				done <- sendFileWithProgress(sender, filepath.Join(work, name), name)
+			}(sender, name)
+		}
+	}
+	for range contents {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatal("uploads in both directions did not complete")
+		}
+	}
+
+	for name, folder := range destinations {
+		received, err := os.ReadFile(filepath.Join(folder, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, contents[name]) {
+			t.Errorf("%s: received %d bytes that differ from the %d sent", name, len(received), len(contents[name]))
+		}
+	}
+}
+
+func TestSessionCloseWhileWriting(t *testing.T) {
+	conn, other := net.Pipe()
+	defer other.Close()
+	session, err := newSession(Config{Mode: "peer", Folder: t.TempDir()}, conn, PeerInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		session.writeLoop()
+		close(stopped)
+	}()
+
+	// Nothing reads the other end, the write blocks until the pipe closes
+	sent := make(chan error, 1)
+	go func() { sent <- session.sendChunk(1, 0, []byte("stuck")) }()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		session.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for a blocked write")
+	}
+	if err := <-sent; err == nil {
+		t.Errorf("write to a closed session succeeded")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writeLoop still running")
+	}
+}
+
+func TestSessionListing(t *testing.T) {
+	work := inTempDir(t)
+	folder := filepath.Join(work, "shared")
+	if err := os.MkdirAll(filepath.Join(folder, "small"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, "small", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Long names make the listing larger than one frame well before any
+	// entry count limit would
+	const files = MaxListBytes / 200
+	for i := 0; i < files; i++ {
+		name := fmt.Sprintf("%04d-%s.txt", i, strings.Repeat("x", 240))
+		if err := os.WriteFile(filepath.Join(folder, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, peer := pipeSessions(t, folder)
+
+	entries, truncated, err := requestListing(peer, "small", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated || len(entries) != 1 || entries[0].Path != "small/a.txt" {
+		t.Errorf("small listing: %d entries, truncated %v", len(entries), truncated)
+	}
+
+	entries, truncated, err = requestListing(peer, "", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated || len(entries) == 0 || len(entries) >= files {
+		t.Errorf("large listing: %d entries, truncated %v", len(entries), truncated)
+	}
+}
@@ -0,0 +1,494 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : sync.go                                                        //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 15:02:27 by aallali                                  //
+//   Updated: 2026/10/17 23:59:04 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Folder sync
+//
+// When both nodes enable Config.Sync, each one sends the index of its shared
+// folder right after connecting and pushes whatever the other side is missing
+// or has an older version of. From then on a recursive watcher turns local
+// changes into uploads, "mkdir" and "delete" operations. Files are pushed
+// once they settle, like watched files (see WatchDebounce). Paths on the wire
+// are relative to the shared folder and always use forward slashes.
+
+// SyncIndexBatch is the number of entries per "sync-index" message, it keeps
+// control frames small
+const SyncIndexBatch = 1000
+
+// SyncEntry describes one file or directory of the shared folder
+type SyncEntry struct {
+	Path    string `json:"path"`           // Relative to the shared folder, slash separated
+	Size    int64  `json:"size"`           // File size in bytes
+	ModTime int64  `json:"mtime"`          // Unix nanoseconds
+	Hash    string `json:"hash,omitempty"` // SHA-256 of the content, empty for directories
+	Dir     bool   `json:"dir,omitempty"`
+}
+
+// isStatePath reports whether a relative path belongs to our own bookkeeping
+func isStatePath(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	return rel == StateDir || strings.HasPrefix(rel, StateDir+"/")
+}
+
+// relativePath converts a path under the shared folder to its wire form
+func relativePath(config Config, path string) (string, bool) {
+	rel, err := filepath.Rel(config.Folder, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// makeDirs creates dir and its missing parents, marking each one as received
+// so the sync watcher does not send them back
+func makeDirs(session *Session, dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || d == filepath.Dir(d) {
+			break
+		}
+		missing = append(missing, d)
+	}
+	for _, d := range missing {
+		markReceived(session, d)
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// scanFolder lists the shared folder with the hash of every file. A file
+// that kept its size and mtime since it was last hashed is not read again
+func scanFolder(config Config) ([]SyncEntry, error) {
+	var entries []SyncEntry
+	err := filepath.WalkDir(config.Folder, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, ok := relativePath(config, path)
+		if !ok {
+			return nil
+		}
+		if isStatePath(rel) {
+			return filepath.SkipDir
+		}
+		if isIgnored(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil // vanished while scanning
+		}
+		entry := SyncEntry{Path: rel, ModTime: info.ModTime().UnixNano(), Dir: d.IsDir()}
+		if info.Mode().IsRegular() {
+			entry.Size = info.Size()
+			if entry.Hash = lookupHash(path, info); entry.Hash == "" {
+				if entry.Hash, err = hashFile(path); err != nil {
+					return nil
+				}
+			}
+		} else if !d.IsDir() {
+			return nil // symlinks, sockets... are not synced
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+func sendSyncIndex(session *Session, entries []SyncEntry) error {
+	for start := 0; ; start += SyncIndexBatch {
+		end := start + SyncIndexBatch
+		status := "more"
+		if end >= len(entries) {
+			end = len(entries)
+			status = "done"
+		}
+		if err := session.send(Message{Action: "sync-index", Entries: entries[start:end], Status: status}); err != nil {
+			return err
+		}
+		if status == "done" {
+			return nil
+		}
+	}
+}
+
+// receiveSyncIndex buffers a batch and returns the full index once complete
+func (s *Session) receiveSyncIndex(message Message) ([]SyncEntry, bool) {
+	s.remoteIndexMutex.Lock()
+	defer s.remoteIndexMutex.Unlock()
+	s.remoteIndex = append(s.remoteIndex, message.Entries...)
+	if message.Status != "done" {
+		return nil, false
+	}
+	index := s.remoteIndex
+	s.remoteIndex = nil
+	return index, true
+}
+
+// setLocalIndex records the scan sent to the peer, ok is false when it failed
+func (s *Session) setLocalIndex(entries []SyncEntry, err error) {
+	s.localIndex, s.localIndexOK = entries, err == nil
+	close(s.localScanned)
+}
+
+// waitLocalIndex returns the scan of our folder once runSync made it, the
+// peer's index can arrive first
+func (s *Session) waitLocalIndex() ([]SyncEntry, bool) {
+	select {
+	case <-s.localScanned:
+		return s.localIndex, s.localIndexOK
+	case <-s.done:
+		return nil, false
+	}
+}
+
+// reconcile pushes what the peer lacks or has an older version of, the peer
+// does the same with our index so both end up with the union of the trees.
+// A file agreed on before is pushed when it changed here since, whatever the
+// dates say, so edits made on both sides meanwhile show up as a conflict.
+// The local side is the index runSync sent, later changes reach the peer
+// through the watcher
+func reconcile(config Config, session *Session, remote []SyncEntry) {
+	local, ok := session.waitLocalIndex()
+	if !ok {
+		return
+	}
+
+	remoteByPath := make(map[string]SyncEntry, len(remote))
+	for _, entry := range remote {
+		remoteByPath[entry.Path] = entry
+	}
+
+	var files []upload
+	for _, entry := range local {
+		theirs, exists := remoteByPath[entry.Path]
+		if entry.Dir {
+			if !exists {
+				session.send(Message{Action: "mkdir", Path: entry.Path})
+			}
+			continue
+		}
+		if exists {
+			last := syncedHash(session, entry.Path)
+			if theirs.Hash == entry.Hash || (last != "" && entry.Hash == last) || (last == "" && theirs.ModTime >= entry.ModTime) {
+				continue
+			}
+		}
+		files = append(files, upload{filepath.Join(config.Folder, filepath.FromSlash(entry.Path)), entry.Path})
+	}
+	pushed, _ := sendFiles(session, files)
+	logMessage("Sync: initial reconcile with %s done, %d file(s) pushed\n", session, pushed)
+}
+
+// rejectOperation reports a folder operation we refused to apply
+func rejectOperation(session *Session, message Message, err error) {
+	logMessage("Rejected %s from %s: %v\n", message.Action, session, err)
+	session.send(Message{Action: "notification", Content: fmt.Sprintf("Rejected %s: %v", message.Action, err)})
+}
+
+// applyMkdir handles a "mkdir" operation from the peer
+func applyMkdir(config Config, session *Session, message Message) {
+	dir, err := resolvePeerPath(config, message.Path)
+	if err != nil {
+		rejectOperation(session, message, err)
+		return
+	}
+	if err := makeDirs(session, dir); err != nil {
+		logMessage("Sync: error creating %s: %v\n", message.Path, err)
+	}
+}
+
+// checkWatchedOperation refuses a delete or rename of anything but a regular
+// file when folder sync is off: watched files are the only thing the peer can
+// delete or rename then, and a directory would go with all it holds
+func checkWatchedOperation(session *Session, info os.FileInfo, rel string) error {
+	if session.supports(CapSync) || info.Mode().IsRegular() {
+		return nil
+	}
+	return fmt.Errorf("%s is not a regular file", rel)
+}
+
+// applyDelete handles a "delete" operation from the peer
+func applyDelete(config Config, session *Session, message Message) {
+	path, err := resolvePeerPath(config, message.Path)
+	if err != nil {
+		rejectOperation(session, message, err)
+		return
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		logMessage("Error deleting %s: %v\n", message.Path, err)
+		return
+	}
+	if err := checkWatchedOperation(session, info, message.Path); err != nil {
+		rejectOperation(session, message, err)
+		return
+	}
+	markReceived(session, path)
+	if err := removePath(config, path, message.Path); err != nil {
+		logMessage("Error deleting %s: %v\n", message.Path, err)
+		return
+	}
+	logMessage("Deleted %s on behalf of %s\n", message.Path, session)
+}
+
+// applyRename handles a "rename" operation from the peer
+func applyRename(config Config, session *Session, message Message) {
+	from, err := resolvePeerPath(config, message.Path)
+	if err != nil {
+		rejectOperation(session, message, err)
+		return
+	}
+	to, err := resolvePeerPath(config, message.Target)
+	if err != nil {
+		rejectOperation(session, message, err)
+		return
+	}
+	info, err := os.Lstat(from)
+	if os.IsNotExist(err) {
+		logMessage("Cannot rename %s to %s: no such file\n", message.Path, message.Target)
+		return
+	}
+	if err != nil {
+		logMessage("Error renaming %s: %v\n", message.Path, err)
+		return
+	}
+	if err := checkWatchedOperation(session, info, message.Path); err != nil {
+		rejectOperation(session, message, err)
+		return
+	}
+	if info, err := os.Lstat(to); err == nil {
+		// Would be replaced by the rename
+		if err := checkWatchedOperation(session, info, message.Target); err != nil {
+			rejectOperation(session, message, err)
+			return
+		}
+	}
+	if err := makeDirs(session, filepath.Dir(to)); err != nil {
+		logMessage("Error renaming %s: %v\n", message.Path, err)
+		return
+	}
+
+	markReceived(session, from)
+	markReceived(session, to)
+	if _, err := os.Lstat(to); err == nil && config.Trash {
+		if err := moveToTrash(config, to, message.Target); err != nil {
+			logMessage("Error renaming %s: %v\n", message.Path, err)
+			return
+		}
+	}
+	if err := os.Rename(from, to); err != nil {
+		logMessage("Error renaming %s: %v\n", message.Path, err)
+		return
+	}
+	logMessage("Renamed %s to %s on behalf of %s\n", message.Path, message.Target, session)
+}
+
+// removePath deletes a file or a directory tree, or moves it to the trash
+// when Config.Trash is on
+func removePath(config Config, path, rel string) error {
+	if config.Trash {
+		return moveToTrash(config, path, rel)
+	}
+	return os.RemoveAll(path)
+}
+
+// moveToTrash keeps what the peer deleted in <folder>/.p2p/trash/<time>/<rel>
+func moveToTrash(config Config, path, rel string) error {
+	dest := filepath.Join(config.Folder, TrashDir, time.Now().Format("20060102-150405"), filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	// Deleted twice within the same second, keep both
+	base := dest
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			break
+		}
+		dest = fmt.Sprintf("%s.%d", base, i)
+	}
+	return os.Rename(path, dest)
+}
+
+// cleanupTrash drops deleted files older than TrashMaxAge
+func cleanupTrash(config Config) {
+	dir := filepath.Join(config.Folder, TrashDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) > TrashMaxAge {
+			os.RemoveAll(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// watchTree adds dir and every directory below it to the watcher
+func watchTree(watcher *fsnotify.Watcher, config Config, dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if rel, ok := relativePath(config, path); ok && (isStatePath(rel) || isIgnored(path, true)) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			logMessage("Sync: cannot watch %s: %v\n", path, err)
+		}
+		return nil
+	})
+}
+
+// pushTree sends a directory that appeared locally, its files go through
+// schedule like any other change
+func pushTree(config Config, session *Session, dir string, schedule func(path, rel string)) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, ok := relativePath(config, path)
+		if !ok || wasReceived(session, path) {
+			return nil
+		}
+		if isIgnored(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			session.send(Message{Action: "mkdir", Path: rel})
+		} else if d.Type().IsRegular() {
+			schedule(path, rel)
+		}
+		return nil
+	})
+}
+
+// runSync sends our index to the peer and mirrors local changes until the
+// session ends. Each session has its own run, so what one peer sends reaches
+// the others
+func (s *Session) runSync() {
+	config := s.config
+	watchTree(s.watcher, config, config.Folder)
+
+	entries, err := scanFolder(config)
+	s.setLocalIndex(entries, err)
+	if err != nil {
+		logMessage("Sync: error scanning %s: %v\n", config.Folder, err)
+		return
+	}
+	if err := sendSyncIndex(s, entries); err != nil {
+		logMessage("Sync: error sending index: %v\n", err)
+		return
+	}
+	logMessage("Sync: mirroring %s with %s (%d entries)\n", config.Folder, s, len(entries))
+
+	// Writes come in bursts, a file is pushed once it settles
+	uploads := newUploadSchedule()
+	defer uploads.stop()
+	schedule := func(path, rel string) {
+		uploads.schedule(path, func() {
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() || wasReceived(s, path) || inSync(s, path, rel) {
+				return
+			}
+			if err := sendFileWithProgress(s, path, rel); err != nil {
+				logMessage("Sync: error uploading %s: %v\n", rel, err)
+			}
+		})
+	}
+
+	for {
+		select {
+		case <-s.Done():
+			return
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			rel, inside := relativePath(config, event.Name)
+			if !inside || isStatePath(rel) {
+				continue
+			}
+			if isIgnoredPath(event.Name) {
+				continue
+			}
+
+			switch {
+			case event.Has(fsnotify.Create):
+				info, err := os.Lstat(event.Name)
+				if err != nil {
+					continue
+				}
+				if info.IsDir() {
+					// New directories need their own watch, their content may
+					// have been created before the watch was in place
+					watchTree(s.watcher, config, event.Name)
+					if !wasReceived(s, event.Name) {
+						pushTree(config, s, event.Name, schedule)
+					}
+				} else if !wasReceived(s, event.Name) {
+					schedule(event.Name, rel)
+				}
+
+			case event.Has(fsnotify.Write):
+				if !wasReceived(s, event.Name) {
+					schedule(event.Name, rel)
+				}
+
+			case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+				// A rename shows up as a Rename of the old name followed by a
+				// Create of the new one. A watched directory that was moved
+				// can also report its new name, so only gone paths count
+				if wasReceived(s, event.Name) {
+					continue
+				}
+				if _, err := os.Lstat(event.Name); err == nil {
+					continue
+				}
+				uploads.cancel(event.Name)
+				if err := s.send(Message{Action: "delete", Path: rel}); err != nil {
+					logMessage("Sync: error sending delete of %s: %v\n", rel, err)
+				}
+			}
+
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			logMessage("Sync watcher error: %v\n", err)
+		}
+	}
+}
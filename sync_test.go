@@ -0,0 +1,67 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : sync_test.go                                                   //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 23:59:04 by aallali                                  //
+//   Updated: 2026/10/17 23:59:04 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScanFolderReusesHashes(t *testing.T) {
+	folder := t.TempDir()
+	file := filepath.Join(folder, "a.txt")
+	if err := os.WriteFile(file, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	scan := func() string {
+		t.Helper()
+		entries, err := scanFolder(Config{Folder: folder})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Path != "a.txt" {
+			t.Fatalf("unexpected scan %+v", entries)
+		}
+		return entries[0].Hash
+	}
+	first := scan()
+
+	// Same size and mtime: the file is taken as unchanged and not read
+	if err := os.WriteFile(file, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if hash := scan(); hash != first {
+		t.Errorf("unchanged file hashed again: %s, want %s", hash, first)
+	}
+
+	// A new mtime is a change
+	modTime = modTime.Add(time.Minute)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	want, err := hashFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := scan(); hash == first || hash != want {
+		t.Errorf("changed file kept hash %s, want %s", hash, want)
+	}
+}
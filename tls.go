@@ -0,0 +1,286 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : tls.go                                                         //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 11:20:14 by aallali                                  //
+//   Updated: 2026/10/17 11:20:14 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CertFile       = "node.crt"    // Self-signed certificate, created on first run
+	KeyFile        = "node.key"    // Private key matching CertFile
+	KnownPeersFile = "known_peers" // Pinned fingerprints, one "<host address or peer node id> <fingerprint>" per line
+)
+
+// tlsHandshakeRecord is the first byte of every TLS connection, a frame never
+// starts with it
+const tlsHandshakeRecord = 0x16
+
+// errFingerprintChanged is returned when a node presents a different key than
+// the one pinned on first connect
+var errFingerprintChanged = errors.New("fingerprint changed")
+
+// errTLSMismatch is returned when only one side has "tls" turned on
+var errTLSMismatch = errors.New("tls setting differs")
+
+var knownPeersMutex sync.Mutex
+
+// loadIdentity returns this node's certificate, generating a new key pair
+// the first time it runs
+func loadIdentity(config Config) (tls.Certificate, error) {
+	if _, err := os.Stat(CertFile); err == nil {
+		return tls.LoadX509KeyPair(CertFile, KeyFile)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "p2p-" + config.NodeID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(20, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(KeyFile, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(CertFile, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	logMessage("Generated node key pair, fingerprint %s\n", fingerprint(der))
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// fingerprint formats a certificate hash the way ssh prints host keys
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func lookupKnownPeer(address string) (string, bool) {
+	file, err := os.Open(KnownPeersFile)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == address {
+			return fields[1], true
+		}
+	}
+	return "", false
+}
+
+func addKnownPeer(address, fp string) error {
+	file, err := os.OpenFile(KnownPeersFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%s %s\n", address, fp)
+	return err
+}
+
+// pendingPin is a fingerprint seen for the first time. It is only stored
+// once the other side proved it knows the password, so a failed login can
+// neither claim a node id nor grow KnownPeersFile
+type pendingPin struct {
+	kind, name, fp string
+}
+
+// checkPinned implements trust-on-first-use: a fingerprint other than the
+// one stored in KnownPeersFile for a name is refused, a name seen for the
+// first time is returned to be pinned after authentication
+func checkPinned(kind, name string, certificates []*x509.Certificate) (*pendingPin, error) {
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("%s presented no certificate", kind)
+	}
+	fp := fingerprint(certificates[0].Raw)
+
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+
+	pinned, known := lookupKnownPeer(name)
+	if !known {
+		return &pendingPin{kind, name, fp}, nil
+	}
+	if pinned != fp {
+		return nil, fmt.Errorf("%s %w: %s pinned %s, got %s", kind, errFingerprintChanged, name, pinned, fp)
+	}
+	return nil, nil
+}
+
+// save stores the fingerprint, nil means there is nothing new to pin. The
+// name is looked up again, another connection may have pinned it meanwhile
+func (p *pendingPin) save() error {
+	if p == nil {
+		return nil
+	}
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+
+	pinned, known := lookupKnownPeer(p.name)
+	if known {
+		if pinned != p.fp {
+			return fmt.Errorf("%s %w: %s pinned %s, got %s", p.kind, errFingerprintChanged, p.name, pinned, p.fp)
+		}
+		return nil
+	}
+	logMessage("Pinning %s %s with fingerprint %s\n", p.kind, p.name, p.fp)
+	return addKnownPeer(p.name, p.fp)
+}
+
+// verifyPeerPinned checks the certificate a peer presented against the one
+// pinned for the node id it sent in its hello, so no one can take over the
+// identity of a known peer. Addresses always hold a ":", node ids never do
+func verifyPeerPinned(conn net.Conn, nodeID string) (*pendingPin, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	if nodeID == "" || strings.ContainsAny(nodeID, ": \t\r\n") {
+		return nil, fmt.Errorf("invalid node id %q", nodeID)
+	}
+	return checkPinned("peer", nodeID, tlsConn.ConnectionState().PeerCertificates)
+}
+
+// peekedConn replays the bytes read ahead by matchTransport
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// matchTransport tells a TLS peer from a plain one by the first byte it
+// sent, so a "tls" setting that differs between the nodes is reported as such
+// instead of as a broken frame or handshake. Either way the peer is answered
+// in clear: a plain peer reads a refused hello, a TLS peer fails its
+// handshake on a record that is not TLS
+func matchTransport(conn net.Conn, useTLS bool) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch peerTLS := first[0] == tlsHandshakeRecord; {
+	case peerTLS && !useTLS:
+		writeControl(conn, 0, HelloMessage{Protocol: ProtocolVersion, Version: VERSION, Error: `host does not use TLS, set "tls": false`})
+		return nil, fmt.Errorf("%w: peer uses TLS, it is off here", errTLSMismatch)
+	case !peerTLS && useTLS:
+		writeControl(conn, 0, HelloMessage{Protocol: ProtocolVersion, Version: VERSION, Error: `host requires TLS, set "tls": true`})
+		return nil, fmt.Errorf("%w: TLS required, peer connects without it", errTLSMismatch)
+	}
+	return &peekedConn{conn, reader}, nil
+}
+
+// serverTLS wraps an accepted connection, the handshake runs before the
+// hello exchange so nothing crosses the wire in clear. Peers present their
+// self-signed certificate too, it is pinned once their node id is known
+func serverTLS(conn net.Conn, cert tls.Certificate) (net.Conn, error) {
+	tlsConn := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	})
+
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer tlsConn.SetDeadline(time.Time{})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// clientTLS wraps a dialed connection, the host certificate is self-signed so
+// it is checked against the pinned fingerprint instead of a CA. A host seen
+// for the first time comes back as a pin to save once authenticated
+func clientTLS(conn net.Conn, cert tls.Certificate, address string) (net.Conn, *pendingPin, error) {
+	var pin *pendingPin
+	tlsConn := tls.Client(conn, &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true, // replaced by VerifyConnection below
+		VerifyConnection: func(state tls.ConnectionState) error {
+			var err error
+			pin, err = checkPinned("host", address, state.PeerCertificates)
+			return err
+		},
+	})
+
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer tlsConn.SetDeadline(time.Time{})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, nil, err
+	}
+	return tlsConn, pin, nil
+}
+
+func warnFingerprintChanged(err error) {
+	logMessage(`
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+Someone could be eavesdropping on you right now, or the host
+simply generated a new key pair.
+%v
+If the change is expected, remove the host's line from '%s' and reconnect.
+`, err, KnownPeersFile)
+}
@@ -0,0 +1,228 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : tls_test.go                                                    //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 11:47:33 by aallali                                  //
+//   Updated: 2026/10/17 11:47:33 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// inTempDir moves to a new directory for the rest of the test, keys and
+// known_peers are written relative to the working directory
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := t.TempDir()
+	if err := os.Chdir(work); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return work
+}
+
+// newIdentity generates a key pair in its own directory
+func newIdentity(t *testing.T) tls.Certificate {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	cert, err := loadIdentity(Config{NodeID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// handshake runs TLS over a pipe and returns the host side
+func handshake(t *testing.T, hostCert, peerCert tls.Certificate) net.Conn {
+	t.Helper()
+	hostConn, peerConn := net.Pipe()
+	t.Cleanup(func() {
+		hostConn.Close()
+		peerConn.Close()
+	})
+	peerErr := make(chan error, 1)
+	go func() {
+		_, _, err := clientTLS(peerConn, peerCert, "host:23456")
+		peerErr <- err
+	}()
+	conn, err := serverTLS(hostConn, hostCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-peerErr; err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestPeerPinning(t *testing.T) {
+	hostCert, peerCert, otherCert := newIdentity(t), newIdentity(t), newIdentity(t)
+	inTempDir(t)
+
+	pin, err := verifyPeerPinned(handshake(t, hostCert, peerCert), "node1")
+	if err != nil || pin == nil {
+		t.Fatalf("first connection: pin %v, %v", pin, err)
+	}
+	if err := pin.save(); err != nil {
+		t.Fatal(err)
+	}
+	if pin, err := verifyPeerPinned(handshake(t, hostCert, peerCert), "node1"); err != nil || pin != nil {
+		t.Errorf("same key: pin %v, %v", pin, err)
+	}
+	if _, err := verifyPeerPinned(handshake(t, hostCert, otherCert), "node1"); !errors.Is(err, errFingerprintChanged) {
+		t.Errorf("other key under a known node id: %v", err)
+	}
+	for _, nodeID := range []string{"", "host:23456", "a b"} {
+		if _, err := verifyPeerPinned(handshake(t, hostCert, peerCert), nodeID); err == nil {
+			t.Errorf("node id %q accepted", nodeID)
+		}
+	}
+
+	// Two connections claim a new node id at once, the first to log in wins
+	first, err := verifyPeerPinned(handshake(t, hostCert, otherCert), "node2")
+	if err != nil {
+		t.Fatalf("new node refused: %v", err)
+	}
+	second, err := verifyPeerPinned(handshake(t, hostCert, peerCert), "node2")
+	if err != nil {
+		t.Fatalf("new node refused: %v", err)
+	}
+	if err := first.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.save(); !errors.Is(err, errFingerprintChanged) {
+		t.Errorf("second key saved under the same node id: %v", err)
+	}
+}
+
+func TestPinnedAfterAuthentication(t *testing.T) {
+	hostCert, peerCert := newIdentity(t), newIdentity(t)
+	inTempDir(t)
+	t.Cleanup(func() {
+		ipJail.mutex.Lock()
+		delete(ipJail.attempts, "pipe")
+		ipJail.mutex.Unlock()
+	})
+
+	// connect runs the peer side of a login against admitPeer
+	connect := func(password string) error {
+		hostConn, peerConn := net.Pipe()
+		defer peerConn.Close()
+		go admitPeer(Config{Mode: "host", TLS: true, Password: "secret"}, hostConn, hostCert, 1)
+
+		conn, _, err := clientTLS(peerConn, peerCert, "host:23456")
+		if err != nil {
+			return err
+		}
+		if _, err := sendHello(conn, Config{Mode: "peer", TLS: true, NodeID: "node1"}); err != nil {
+			return err
+		}
+		_, err = authenticateWithHost(conn, password)
+		return err
+	}
+
+	if err := connect("guess"); !errors.Is(err, errAuthFailed) {
+		t.Fatalf("bad password: %v", err)
+	}
+	if _, known := lookupKnownPeer("node1"); known {
+		t.Errorf("node id pinned by a failed login")
+	}
+
+	if err := connect("secret"); err != nil {
+		t.Fatal(err)
+	}
+	// The host pins right after its side of the login, poll for it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, known := lookupKnownPeer("node1"); known {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("node id not pinned after a successful login")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransportMismatch(t *testing.T) {
+	hostCert, peerCert := newIdentity(t), newIdentity(t)
+	inTempDir(t)
+
+	// A plain peer sends its hello, a TLS host answers with a refused one
+	hostConn, peerConn := net.Pipe()
+	defer hostConn.Close()
+	defer peerConn.Close()
+	go writeControl(peerConn, 0, localHello(Config{Mode: "peer", NodeID: "node1"}))
+	refused := make(chan HelloMessage, 1)
+	go func() {
+		var hello HelloMessage
+		readControl(peerConn, &hello)
+		refused <- hello
+	}()
+	if _, err := matchTransport(hostConn, true); !errors.Is(err, errTLSMismatch) {
+		t.Errorf("plain peer on a TLS host: %v", err)
+	}
+	if hello := <-refused; !strings.Contains(hello.Error, "requires TLS") {
+		t.Errorf("plain peer was told %q", hello.Error)
+	}
+
+	// A TLS peer gets a plain frame instead of a server hello, it stops
+	// reading after the record header
+	hostConn, peerConn = net.Pipe()
+	defer hostConn.Close()
+	peerErr := make(chan error, 1)
+	go func() {
+		_, _, err := clientTLS(peerConn, peerCert, "host:23456")
+		peerErr <- err
+		peerConn.Close()
+	}()
+	if _, err := matchTransport(hostConn, false); !errors.Is(err, errTLSMismatch) {
+		t.Errorf("TLS peer on a plain host: %v", err)
+	}
+	var header tls.RecordHeaderError
+	if err := <-peerErr; !errors.As(err, &header) {
+		t.Errorf("TLS peer on a plain host: %v", err)
+	}
+
+	// Matching settings go through, the peeked byte is not lost
+	hostConn, peerConn = net.Pipe()
+	defer hostConn.Close()
+	defer peerConn.Close()
+	go func() {
+		_, _, err := clientTLS(peerConn, peerCert, "host:23456")
+		peerErr <- err
+	}()
+	conn, err := matchTransport(hostConn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serverTLS(conn, hostCert); err != nil {
+		t.Errorf("TLS handshake after the peek: %v", err)
+	}
+	if err := <-peerErr; err != nil {
+		t.Errorf("TLS peer: %v", err)
+	}
+}
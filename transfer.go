@@ -0,0 +1,806 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : transfer.go                                                    //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 13:35:52 by aallali                                  //
+//   Updated: 2026/10/17 13:35:52 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StateDir      = ".p2p"              // Bookkeeping inside the shared folder, never synced
+	PartialDir    = ".p2p/partial"      // Partial uploads waiting to be resumed
+	PartialMaxAge = 7 * 24 * time.Hour  // Partial uploads older than this are dropped at startup
+	TrashDir      = ".p2p/trash"        // Files deleted by the peer when Config.Trash is on
+	TrashMaxAge   = 30 * 24 * time.Hour // Trashed files older than this are dropped at startup
+	ReplyTimeout  = 30 * time.Second    // How long a sender waits for the receiver to answer
+
+	MaxUploadAttempts  = 3               // Uploads rejected by the receiver's verification are retried this many times
+	MaxParallelUploads = 4               // Uploads running at once on a session, the others wait in the queue
+	EchoWindow         = 2 * time.Second // Watcher events on files written for the peer are ignored this long
+)
+
+// errCorrupt is returned when the receiver rejected what we sent
+var errCorrupt = errors.New("transfer corrupted")
+
+// Add new type for file assembly
+type FileAssembly struct {
+	Path         string // Destination path inside the shared folder
+	Name         string // Path as sent by the peer, used for progress output
+	Hash         string // SHA-256 of the whole file as announced by the sender
+	Base         string // Hash of the version the sender last synced with us
+	TotalSize    int64
+	ReceivedSize int64
+	Skipped      int64 // Bytes dropped after a bad chunk, until the sender finishes the stream
+	Failed       bool  // A chunk failed its checksum, the rest of the stream is ignored
+	TempFile     *os.File
+	BaseFile     *os.File   // Our previous copy, delta uploads copy blocks from it
+	Signature    *Signature // Sent to the sender when it can send a delta
+	Progress     *Progress  // Nil once the transfer is over
+	Mode         uint32     // Attributes of the sender's copy, see applyMeta
+	ModTime      int64
+	Owner        *FileOwner
+}
+
+// receivedKey identifies a file written on behalf of one peer
+type receivedKey struct {
+	session int
+	path    string
+}
+
+// Files we just wrote on behalf of a peer, mapped to when their watcher
+// events stop being ignored, so changes are not echoed back to the sender.
+// Other peers still get them, the host relays what one peer sends
+var (
+	receivedFiles      = make(map[receivedKey]time.Time)
+	receivedFilesMutex sync.Mutex
+)
+
+// receivedKeyFor uses absolute paths, watchers report them the way they were
+// added while received files are resolved against the absolute folder
+func receivedKeyFor(session *Session, filePath string) receivedKey {
+	if abs, err := filepath.Abs(filePath); err == nil {
+		filePath = abs
+	}
+	return receivedKey{session.ID, filePath}
+}
+
+func markReceived(session *Session, filePath string) {
+	receivedFilesMutex.Lock()
+	receivedFiles[receivedKeyFor(session, filePath)] = time.Now().Add(EchoWindow)
+	receivedFilesMutex.Unlock()
+}
+
+func wasReceived(session *Session, filePath string) bool {
+	receivedFilesMutex.Lock()
+	defer receivedFilesMutex.Unlock()
+	key := receivedKeyFor(session, filePath)
+	until, exists := receivedFiles[key]
+	if exists && time.Now().After(until) {
+		delete(receivedFiles, key)
+		return false
+	}
+	return exists
+}
+
+// Replies the receiver sends back for a stream ("upload-ack"...) are routed
+// to the goroutine uploading on that stream
+func (s *Session) expectReply(stream uint32) <-chan Message {
+	s.repliesMutex.Lock()
+	defer s.repliesMutex.Unlock()
+	reply := make(chan Message, 4)
+	s.replies[stream] = reply
+	return reply
+}
+
+func (s *Session) cancelReply(stream uint32) {
+	s.repliesMutex.Lock()
+	delete(s.replies, stream)
+	s.repliesMutex.Unlock()
+}
+
+func (s *Session) deliverReply(message Message) {
+	s.repliesMutex.Lock()
+	defer s.repliesMutex.Unlock()
+	if reply, exists := s.replies[message.Stream]; exists {
+		select {
+		case reply <- message:
+		default:
+		}
+	}
+}
+
+// failPendingReplies wakes up every waiting sender when the connection drops
+func (s *Session) failPendingReplies() {
+	s.repliesMutex.Lock()
+	defer s.repliesMutex.Unlock()
+	for stream, reply := range s.replies {
+		close(reply)
+		delete(s.replies, stream)
+	}
+}
+
+func waitReply(reply <-chan Message) (Message, error) {
+	select {
+	case message, ok := <-reply:
+		if !ok {
+			return Message{}, errNotConnected
+		}
+		return message, nil
+	case <-time.After(ReplyTimeout):
+		return Message{}, fmt.Errorf("no answer from peer after %v", ReplyTimeout)
+	}
+}
+
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	rememberHash(filePath, info, sum)
+	return sum, nil
+}
+
+// knownHash is the last hash computed for a file, valid while the file keeps
+// the size and mtime it had then
+type knownHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+var (
+	knownHashes      = make(map[string]knownHash)
+	knownHashesMutex sync.Mutex
+)
+
+func rememberHash(filePath string, info os.FileInfo, hash string) {
+	if abs, err := filepath.Abs(filePath); err == nil {
+		filePath = abs
+	}
+	knownHashesMutex.Lock()
+	knownHashes[filePath] = knownHash{info.Size(), info.ModTime(), hash}
+	knownHashesMutex.Unlock()
+}
+
+// lookupHash returns the hash of a file if it was computed since its last
+// change, "" otherwise
+func lookupHash(filePath string, info os.FileInfo) string {
+	if abs, err := filepath.Abs(filePath); err == nil {
+		filePath = abs
+	}
+	knownHashesMutex.Lock()
+	defer knownHashesMutex.Unlock()
+	known, exists := knownHashes[filePath]
+	if !exists || known.size != info.Size() || !known.modTime.Equal(info.ModTime()) {
+		return ""
+	}
+	return known.hash
+}
+
+// partialPath names the partial file after the sender, the destination and
+// the content hash, so a resumed upload only continues bytes of the very same
+// file and two peers sending the same file never share a partial
+func partialPath(config Config, session *Session, message Message) string {
+	id := sha256.Sum256([]byte(session.Info.NodeID + "/" + message.Path))
+	name := hex.EncodeToString(id[:8])
+	if len(message.Hash) >= 32 {
+		if _, err := hex.DecodeString(message.Hash[:32]); err == nil {
+			name += "-" + message.Hash[:32]
+		}
+	}
+	return filepath.Join(config.Folder, PartialDir, name+".part")
+}
+
+// openAssembly prepares the receiving side of an upload, picking up a partial
+// file left by an interrupted transfer when the peer supports resuming
+func openAssembly(config Config, session *Session, message Message) (*FileAssembly, error) {
+	filePath, err := resolvePeerPath(config, message.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := makeDirs(session, filepath.Dir(filePath)); err != nil {
+		return nil, err
+	}
+
+	partial := partialPath(config, session, message)
+	if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
+		return nil, err
+	}
+
+	// Partials of older contents of the same file can never be resumed
+	id := filepath.Base(partial)[:16]
+	if stale, err := filepath.Glob(filepath.Join(filepath.Dir(partial), id+"*.part")); err == nil {
+		for _, name := range stale {
+			if name != partial {
+				os.Remove(name)
+			}
+		}
+	}
+
+	tempFile, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := int64(0)
+	if message.Hash != "" && session.supports(CapResume) {
+		if info, err := tempFile.Stat(); err == nil && info.Size() <= message.TotalSize {
+			offset = info.Size()
+		}
+	}
+	if err := tempFile.Truncate(offset); err != nil {
+		tempFile.Close()
+		return nil, err
+	}
+	if _, err := tempFile.Seek(offset, io.SeekStart); err != nil {
+		tempFile.Close()
+		return nil, err
+	}
+
+	assembly := &FileAssembly{
+		Path:         filePath,
+		Name:         message.Path,
+		Hash:         message.Hash,
+		Base:         message.Base,
+		TotalSize:    message.TotalSize,
+		ReceivedSize: offset,
+		TempFile:     tempFile,
+		Mode:         message.Mode,
+		ModTime:      message.ModTime,
+		Owner:        message.Owner,
+	}
+	// A fresh upload of a file we already have only needs the changes
+	if message.Delta && offset == 0 && session.supports(CapDelta) {
+		if err := assembly.openBase(); err != nil {
+			logMessage("Receiving %s in full: %v\n", message.Path, err)
+		}
+	}
+	if !assembly.complete() {
+		assembly.Progress = startProgress(fmt.Sprintf("📥 Down %s from #%d", message.Path, session.ID),
+			"📥 "+path.Base(message.Path), offset, message.TotalSize)
+	}
+	return assembly, nil
+}
+
+// openBase prepares our copy of the file for a delta upload
+func (a *FileAssembly) openBase() error {
+	base, err := os.Open(a.Path)
+	if err != nil {
+		return nil // Nothing to start from
+	}
+	info, err := base.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() < DeltaMinSize {
+		base.Close()
+		return nil
+	}
+	signature, err := computeSignature(base, info.Size())
+	if err != nil {
+		base.Close()
+		return err
+	}
+	a.BaseFile, a.Signature = base, signature
+	return nil
+}
+
+// closeFiles releases the files of an assembly, it is fine on placeholders
+func (a *FileAssembly) closeFiles() {
+	if a.TempFile != nil {
+		a.TempFile.Close()
+	}
+	if a.BaseFile != nil {
+		a.BaseFile.Close()
+	}
+}
+
+func (a *FileAssembly) write(chunk []byte) error {
+	if _, err := a.TempFile.Write(chunk); err != nil {
+		return err
+	}
+	a.ReceivedSize += int64(len(chunk))
+
+	if a.Progress != nil {
+		a.Progress.set(a.ReceivedSize)
+		if a.complete() {
+			a.Progress.finish()
+			a.Progress = nil
+		}
+	}
+	return nil
+}
+
+func (a *FileAssembly) complete() bool {
+	return a.ReceivedSize >= a.TotalSize
+}
+
+// skip accounts for a chunk dropped after a failure and reports whether the
+// sender is done with the stream
+func (a *FileAssembly) skip(frame Frame) bool {
+	a.Skipped += int64(chunkSize(frame))
+	return a.ReceivedSize+a.Skipped >= a.TotalSize
+}
+
+// verify checks the assembled bytes against the hash announced by the sender
+func (a *FileAssembly) verify() error {
+	if a.Hash == "" {
+		return nil
+	}
+	if _, err := a.TempFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, a.TempFile); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != a.Hash {
+		return fmt.Errorf("sha256 mismatch: expected %s, got %s", a.Hash, sum)
+	}
+	return nil
+}
+
+// rejectUpload tells the sender its upload will not be saved, the data frames
+// it may already have in flight are swallowed by a failed placeholder
+func rejectUpload(session *Session, message Message, err error) {
+	status := "failed"
+	if errors.Is(err, errUnsafePath) {
+		status = "rejected"
+	}
+	if message.TotalSize > 0 {
+		session.addAssembly(message.Stream, &FileAssembly{Name: message.Path, TotalSize: message.TotalSize, Failed: true})
+	}
+
+	if session.supports(CapResume) || session.supports(CapVerify) {
+		session.send(Message{Action: "upload-result", Stream: message.Stream, Status: status, Content: err.Error()})
+	} else {
+		session.send(Message{Action: "notification", Content: fmt.Sprintf("Upload %s: %v", status, err)})
+	}
+}
+
+// addAssembly registers a new upload, a previous stream for the same file
+// is abandoned by now (the sender restarts after a rejected chunk)
+func (s *Session) addAssembly(stream uint32, assembly *FileAssembly) {
+	s.assemblyMutex.Lock()
+	defer s.assemblyMutex.Unlock()
+	for id, existing := range s.assemblies {
+		if assembly.Path != "" && existing.Path == assembly.Path {
+			existing.Progress.finish()
+			existing.closeFiles()
+			delete(s.assemblies, id)
+		}
+	}
+	s.assemblies[stream] = assembly
+}
+
+func (s *Session) assembly(stream uint32) (*FileAssembly, bool) {
+	s.assemblyMutex.Lock()
+	defer s.assemblyMutex.Unlock()
+	assembly, exists := s.assemblies[stream]
+	return assembly, exists
+}
+
+func (s *Session) removeAssembly(stream uint32) {
+	s.assemblyMutex.Lock()
+	delete(s.assemblies, stream)
+	s.assemblyMutex.Unlock()
+}
+
+// cancelAssembly drops an upload the sender stopped. A paused one keeps its
+// partial file so the sender can resume it later
+func (s *Session) cancelAssembly(message Message) {
+	assembly, exists := s.assembly(message.Stream)
+	if !exists {
+		if message.Stream == 0 && message.Path != "" && message.Hash != "" {
+			s.dropPartial(message)
+		}
+		return
+	}
+	s.removeAssembly(message.Stream)
+	assembly.Progress.finish()
+	if assembly.TempFile == nil {
+		return // Failed placeholder, nothing on disk
+	}
+	assembly.closeFiles()
+	if message.Status == string(TransferPaused) {
+		logMessage("Upload of %s paused by %s at %d/%d B\n", assembly.Name, s, assembly.ReceivedSize, assembly.TotalSize)
+		return
+	}
+	os.Remove(assembly.TempFile.Name())
+	logMessage("Upload of %s cancelled by %s\n", assembly.Name, s)
+}
+
+// dropPartial deletes the partial file of an upload the sender cancelled
+// while it was paused
+func (s *Session) dropPartial(message Message) {
+	if len(message.Hash) < 32 {
+		return
+	}
+	if _, err := hex.DecodeString(message.Hash[:32]); err != nil {
+		return // Not a hash, it never named a partial file
+	}
+	if err := os.Remove(partialPath(s.config, s, message)); err == nil {
+		logMessage("Upload of %s cancelled by %s, partial file removed\n", message.Path, s)
+	}
+}
+
+// closeAssemblies is called when the connection drops, partial files stay on
+// disk so the sender can resume them after reconnecting
+func (s *Session) closeAssemblies() {
+	s.assemblyMutex.Lock()
+	defer s.assemblyMutex.Unlock()
+	for stream, assembly := range s.assemblies {
+		assembly.Progress.finish()
+		assembly.closeFiles()
+		if assembly.ReceivedSize > 0 {
+			logMessage("Keeping partial upload %s (%d/%d B) for resume\n",
+				assembly.Name, assembly.ReceivedSize, assembly.TotalSize)
+		}
+		delete(s.assemblies, stream)
+	}
+}
+
+// cleanupPartials drops partial uploads nobody came back for
+func cleanupPartials(config Config) {
+	dir := filepath.Join(config.Folder, PartialDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) > PartialMaxAge {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// remotePathFor picks the path a file gets inside the peer's folder: relative
+// to Config.UploadRoot (the working directory by default) when the file lives
+// below it, otherwise relative to the parent of base, the path the user named
+func remotePathFor(config Config, base, filePath string) string {
+	root := config.UploadRoot
+	if root == "" {
+		root = "."
+	}
+	for _, dir := range []string{root, filepath.Dir(base)} {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		absFile, err := filepath.Abs(filePath)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(absDir, absFile)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.Base(filePath)
+}
+
+// uploadPath sends a file, or every file below a directory, recreating the
+// relative layout on the peer
+func uploadPath(config Config, session *Session, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return sendFileWithProgress(session, path, remotePathFor(config, path, path))
+	}
+
+	var files []upload
+	failed := 0
+	filepath.WalkDir(path, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			logMessage("Error accessing %s: %v\n", filePath, err)
+			failed++
+			return nil
+		}
+		if d.IsDir() && d.Name() == StateDir {
+			return filepath.SkipDir
+		}
+		if filePath != path && isIgnored(filePath, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			files = append(files, upload{filePath, remotePathFor(config, path, filePath)})
+		}
+		return nil
+	})
+
+	sent, err := sendFiles(session, files)
+	failed += len(files) - sent
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d file(s) failed", failed, sent+failed)
+	}
+	logMessage("Directory uploaded to %s: %s (%d file(s))\n", session, path, sent)
+	return nil
+}
+
+// upload pairs a local file with its path inside the peer's shared folder
+type upload struct {
+	local  string
+	remote string
+}
+
+// sendFiles queues a batch of uploads on a session and waits for all of
+// them, their chunks take turns on the connection. It returns how many files
+// made it and errNotConnected if the session ended midway
+func sendFiles(session *Session, files []upload) (int, error) {
+	queued := make([]*Transfer, len(files))
+	for i, file := range files {
+		queued[i] = transfers.enqueue(session, file.local, file.remote)
+	}
+
+	sent := 0
+	for i, transfer := range queued {
+		if err := transfer.wait(); err != nil {
+			logMessage("Error uploading %s: %v\n", files[i].local, err)
+			continue
+		}
+		sent++
+	}
+
+	if session.isClosed() {
+		return sent, errNotConnected
+	}
+	return sent, nil
+}
+
+// sendFileWithProgress queues an upload of filePath to remotePath inside the
+// peer's shared folder and waits until it is done
+func sendFileWithProgress(session *Session, filePath, remotePath string) error {
+	return transfers.enqueue(session, filePath, remotePath).wait()
+}
+
+// upload runs a transfer taken off the queue, starting over when the receiver
+// rejects it after verification
+func (t *Transfer) upload() error {
+	var err error
+	for attempt := 1; attempt <= MaxUploadAttempts; attempt++ {
+		err = sendFileAttempt(t)
+		if !errors.Is(err, errCorrupt) {
+			return err
+		}
+		t.Full = true // A bad delta must not fail again
+		logMessage("%v, retrying (%d/%d)\n", err, attempt, MaxUploadAttempts)
+	}
+	return err
+}
+
+// checkStopped tells the receiver whether to keep what it has when the
+// transfer was paused or cancelled from the console
+func (t *Transfer) checkStopped(stream uint32, sent, total int64) error {
+	as, stopped := transfers.stopped(t)
+	if !stopped {
+		return nil
+	}
+	if t.Session.supports(CapCancel) {
+		t.Session.send(Message{Action: "cancel", Stream: stream, Status: string(as)})
+	}
+	logMessage("Upload of %s %s at %d/%d bytes\n", t.Remote, as, sent, total)
+	return errInterrupted
+}
+
+// framePayload prepares a chunk for the wire: deflated when that makes it
+// smaller, then sealed when the peer checks chunks
+func framePayload(chunk []byte, flags uint8, c *compressor) ([]byte, uint8) {
+	if c != nil {
+		if compressed := c.compress(chunk); compressed != nil {
+			chunk, flags = compressed, flags|FlagCompressed
+		}
+	}
+	if flags&FlagChecksum != 0 {
+		chunk = sealChunk(chunk)
+	}
+	return chunk, flags
+}
+
+// pollResult returns the receiver's verdict if it already sent one
+func pollResult(reply <-chan Message) *Message {
+	select {
+	case message, ok := <-reply:
+		if ok && message.Action == "upload-result" {
+			return &message
+		}
+	default:
+	}
+	return nil
+}
+
+func sendFileAttempt(t *Transfer) error {
+	session, filePath, remotePath := t.Session, t.Local, t.Remote
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	totalSize := fileInfo.Size()
+
+	hash, err := hashFile(filePath)
+	if err != nil {
+		return fmt.Errorf("hash error: %v", err)
+	}
+	transfers.setHash(t, hash)
+
+	// Announce the upload, the chunks that follow travel as raw data frames
+	stream := newStreamID()
+	resume := session.supports(CapResume)
+	verify := session.supports(CapVerify)
+	var reply <-chan Message
+	if resume || verify {
+		reply = session.expectReply(stream)
+		defer session.cancelReply(stream)
+	}
+	announce := Message{
+		Action:    "upload",
+		Path:      remotePath,
+		TotalSize: totalSize,
+		Hash:      hash,
+		Base:      syncedHash(session, remotePath),
+		Delta:     resume && !t.Full && totalSize >= DeltaMinSize && session.supports(CapDelta),
+		Stream:    stream,
+	}
+	setMeta(&announce, fileInfo)
+	if err := session.send(announce); err != nil {
+		return fmt.Errorf("send error: %v", err)
+	}
+
+	// The receiver tells us how much of this exact file it already has, or
+	// what its older copy looks like
+	sentBytes := int64(0)
+	var signature *Signature
+	if resume {
+		ack, err := waitReply(reply)
+		if err != nil {
+			return err
+		}
+		if ack.Action == "upload-result" && ack.Status != "ok" {
+			return fmt.Errorf("%s refused by peer: %s", remotePath, ack.Content)
+		}
+		if ack.Offset > 0 && ack.Offset <= totalSize {
+			if _, err := file.Seek(ack.Offset, io.SeekStart); err != nil {
+				return err
+			}
+			sentBytes = ack.Offset
+			logMessage("Resuming %s at %d/%d bytes\n", remotePath, sentBytes, totalSize)
+		}
+		if sentBytes == 0 && !t.Full && ack.Signature != nil {
+			if err := ack.Signature.validate(); err != nil {
+				logMessage("Sending %s in full: %v\n", remotePath, err)
+			} else {
+				signature = ack.Signature
+			}
+		}
+		t.peerRate, t.peerLimited = ack.Rate, ack.Limited
+	}
+
+	var flags uint8
+	if verify {
+		flags = FlagChecksum
+	}
+	var c *compressor
+	if session.supports(CapCompress) {
+		c = newCompressor(file, filePath)
+	}
+	frameSize := t.frameSize()
+	buffer := make([]byte, frameSize+ChecksumSize)
+
+	progress := startProgress(fmt.Sprintf("📤 Up %s to #%d", remotePath, session.ID),
+		"📤 "+path.Base(remotePath), sentBytes, totalSize)
+	defer progress.finish()
+	transfers.setProgress(t, sentBytes, totalSize)
+
+	var result *Message
+	if signature != nil {
+		if result, err = sendDelta(t, stream, flags, c, file, totalSize, frameSize, signature, progress, reply); err != nil {
+			return err
+		}
+		sentBytes = totalSize
+	}
+	for sentBytes < totalSize && result == nil {
+		if err := t.checkStopped(stream, sentBytes, totalSize); err != nil {
+			return err
+		}
+
+		n, err := file.Read(buffer[:frameSize])
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read error: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+
+		payload, chunkFlags := framePayload(buffer[:n], flags, c)
+		if err := t.throttle(session.ctx, len(payload)); err != nil {
+			return errNotConnected
+		}
+		if err := session.sendChunk(stream, chunkFlags, payload); err != nil {
+			return fmt.Errorf("send error at %d/%d bytes: %v", sentBytes, totalSize, err)
+		}
+
+		sentBytes += int64(n)
+		progress.addWire(len(payload))
+		progress.set(sentBytes)
+		transfers.setProgress(t, sentBytes, totalSize)
+
+		// The receiver stops listening as soon as a chunk fails its checksum
+		result = pollResult(reply)
+	}
+
+	if result == nil && sentBytes != totalSize {
+		return fmt.Errorf("incomplete transfer: sent %d/%d bytes", sentBytes, totalSize)
+	}
+	progress.finish()
+
+	// Nothing is final until the receiver checked the whole file hash
+	if verify && result == nil {
+		for {
+			message, err := waitReply(reply)
+			if err != nil {
+				return err
+			}
+			if message.Action == "upload-result" {
+				result = &message
+				break
+			}
+		}
+	}
+	if result != nil && result.Status == "corrupt" {
+		return fmt.Errorf("%w: %s rejected by peer: %s", errCorrupt, remotePath, result.Content)
+	}
+	if result != nil && result.Status != "ok" {
+		return fmt.Errorf("%s refused by peer: %s", remotePath, result.Content)
+	}
+
+	recordSynced(session, remotePath, hash)
+	recordSent(filePath, hash, totalSize)
+	logMessage("File transfer to %s completed: %s (%d bytes)\n", session, remotePath, totalSize)
+	return nil
+}
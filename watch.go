@@ -0,0 +1,649 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : watch.go                                                       //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 20:12:37 by aallali                                  //
+//   Updated: 2026/10/17 20:12:37 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watched files
+//
+// A watch on the file itself dies as soon as the file is removed or replaced,
+// which is how most editors save. /w watches the file's directory instead and
+// only reacts to the files marked as watched, so a watch survives any number
+// of saves, deletes and re-creations.
+//
+// /w also takes a directory, watched recursively, or a glob pattern such as
+// "logs/*.log". Each file they hold is registered as a watched file, and files
+// (or sub-directories) created there later are watched and sent too. Wildcards
+// in the directory part of a pattern are only expanded when /w runs.
+
+// RenameWindow is how long a watched file that disappeared may take to come
+// back (replaced by an editor) or to show up under its new name
+const RenameWindow = 300 * time.Millisecond
+
+// A watched file is sent once no event came for it during WatchDebounce and
+// its size and modification time stay the same across a StablePoll, so a file
+// still being written is not sent half done. Each file has its own timer, a
+// burst of writes to one file never holds back another one
+const (
+	WatchDebounce = 500 * time.Millisecond
+	StablePoll    = 200 * time.Millisecond
+	StableMaxWait = 30 * time.Second // A file that never settles, like a busy log, is sent anyway
+)
+
+// watchFile starts watching filePath, fileManager.Mutex must not be held
+func watchFile(watcher *fsnotify.Watcher, filePath string) error {
+	if err := watcher.Add(filepath.Dir(filepath.Clean(filePath))); err != nil {
+		return err
+	}
+	setWatched(filePath, true)
+	noteWatched(filePath)
+	return nil
+}
+
+// unwatchFile stops watching filePath, the directory watch goes away with the
+// last watched file it holds unless a /w directory or pattern covers it
+func unwatchFile(watcher *fsnotify.Watcher, filePath string) error {
+	if !isWatched(filePath) {
+		return os.ErrNotExist
+	}
+	setWatched(filePath, false)
+
+	dir := filepath.Dir(filepath.Clean(filePath))
+	if dirNeeded(dir) {
+		return nil
+	}
+	return watcher.Remove(dir)
+}
+
+// dirNeeded reports whether a directory holds a watched file or falls under
+// a watchRule, its watch must stay then
+func dirNeeded(dir string) bool {
+	watchRulesMutex.Lock()
+	for _, rule := range watchRules {
+		if rule.coversDir(dir) {
+			watchRulesMutex.Unlock()
+			return true
+		}
+	}
+	watchRulesMutex.Unlock()
+
+	fileManager.Mutex.Lock()
+	defer fileManager.Mutex.Unlock()
+	for _, file := range fileManager.Files {
+		if file.Watched && filepath.Dir(filepath.Clean(file.Path)) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func setWatched(filePath string, watched bool) {
+	fileManager.Mutex.Lock()
+	defer fileManager.Mutex.Unlock()
+	for i := range fileManager.Files {
+		if filepath.Clean(fileManager.Files[i].Path) == filepath.Clean(filePath) {
+			fileManager.Files[i].Watched = watched
+			return
+		}
+	}
+}
+
+// noteWatched records the size and modification time of a watched file, so
+// it can be recognized if it is renamed
+func noteWatched(filePath string) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+	fileManager.Mutex.Lock()
+	defer fileManager.Mutex.Unlock()
+	for i := range fileManager.Files {
+		if filepath.Clean(fileManager.Files[i].Path) == filepath.Clean(filePath) {
+			fileManager.Files[i].Size = info.Size()
+			fileManager.Files[i].ModTime = info.ModTime()
+			return
+		}
+	}
+}
+
+// watchedEntry returns the registry entry of a cleaned path
+func watchedEntry(filePath string) (FileEntry, bool) {
+	fileManager.Mutex.Lock()
+	defer fileManager.Mutex.Unlock()
+	for _, file := range fileManager.Files {
+		if filepath.Clean(file.Path) == filePath {
+			return file, true
+		}
+	}
+	return FileEntry{}, false
+}
+
+// isWatched reports whether a cleaned path is one of the watched files
+func isWatched(filePath string) bool {
+	fileManager.Mutex.Lock()
+	defer fileManager.Mutex.Unlock()
+	for _, file := range fileManager.Files {
+		if file.Watched && filepath.Clean(file.Path) == filePath {
+			return true
+		}
+	}
+	return false
+}
+
+// renameWatched follows a watched file to its new name
+func renameWatched(from, to string) {
+	fileManager.Mutex.Lock()
+	defer fileManager.Mutex.Unlock()
+	for i := range fileManager.Files {
+		if filepath.Clean(fileManager.Files[i].Path) == from {
+			fileManager.Files[i].Path = to
+			return
+		}
+	}
+}
+
+// watchRule is a directory or a glob pattern given to /w
+type watchRule struct {
+	Path string // Cleaned directory or pattern
+	Glob bool
+}
+
+var (
+	watchRules      []watchRule
+	watchRulesMutex sync.Mutex
+)
+
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// matches reports whether a cleaned path falls under the rule
+func (r watchRule) matches(path string) bool {
+	if r.Glob {
+		matched, _ := filepath.Match(r.Path, path)
+		return matched
+	}
+	rel, err := filepath.Rel(r.Path, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// coversDir reports whether the rule watches a cleaned directory: the
+// directory itself or one below it, or one the pattern matches files in
+func (r watchRule) coversDir(dir string) bool {
+	if r.Glob {
+		matched, _ := filepath.Match(filepath.Dir(r.Path), dir)
+		return matched
+	}
+	return dir == r.Path || r.matches(dir)
+}
+
+// watchRuleFor returns the rule a new file or directory falls under
+func watchRuleFor(path string) (watchRule, bool) {
+	watchRulesMutex.Lock()
+	defer watchRulesMutex.Unlock()
+	for _, rule := range watchRules {
+		if rule.matches(path) {
+			return rule, true
+		}
+	}
+	return watchRule{}, false
+}
+
+func listWatchRules() []string {
+	watchRulesMutex.Lock()
+	defer watchRulesMutex.Unlock()
+	rules := make([]string, len(watchRules))
+	for i, rule := range watchRules {
+		rules[i] = rule.Path
+	}
+	return rules
+}
+
+// watchPath watches a directory recursively or the files matching a glob
+// pattern, and keeps watching for new ones. It returns how many files it
+// found
+func watchPath(watcher *fsnotify.Watcher, path string) (int, error) {
+	rule := watchRule{Path: filepath.Clean(path), Glob: isGlob(path)}
+	var files []string
+	var err error
+	if rule.Glob {
+		files, err = watchGlob(watcher, rule.Path)
+	} else {
+		files, err = watchDirectory(watcher, rule.Path)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	watchRulesMutex.Lock()
+	defer watchRulesMutex.Unlock()
+	for _, existing := range watchRules {
+		if existing == rule {
+			return len(files), nil
+		}
+	}
+	watchRules = append(watchRules, rule)
+	return len(files), nil
+}
+
+// unwatchPath drops a directory or pattern given to /w along with the files
+// it registered
+func unwatchPath(watcher *fsnotify.Watcher, path string) error {
+	rule := watchRule{Path: filepath.Clean(path), Glob: isGlob(path)}
+	watchRulesMutex.Lock()
+	found := false
+	for i, existing := range watchRules {
+		if existing == rule {
+			watchRules = append(watchRules[:i], watchRules[i+1:]...)
+			found = true
+			break
+		}
+	}
+	watchRulesMutex.Unlock()
+	if !found {
+		return os.ErrNotExist
+	}
+
+	var files []string
+	fileManager.Mutex.Lock()
+	for _, file := range fileManager.Files {
+		if file.Watched && rule.matches(filepath.Clean(file.Path)) {
+			files = append(files, file.Path)
+		}
+	}
+	fileManager.Mutex.Unlock()
+	for _, file := range files {
+		unwatchFile(watcher, file)
+	}
+
+	// Directories without any file left still have a watch
+	if !rule.Glob {
+		filepath.WalkDir(rule.Path, func(dir string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() && !dirNeeded(dir) {
+				watcher.Remove(dir)
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// watchDirectory watches root and every directory below it, and registers the
+// files it holds. It returns the files it registered
+func watchDirectory(watcher *fsnotify.Watcher, root string) ([]string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	var files []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			logMessage("Error accessing %s: %v\n", path, err)
+			return nil
+		}
+		if path != root && isIgnored(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == StateDir {
+				return filepath.SkipDir
+			}
+			return watcher.Add(path)
+		}
+		if d.Type().IsRegular() {
+			registerWatched(path)
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// watchGlob watches the directories a pattern can match files in, and
+// registers the files matching it now
+func watchGlob(watcher *fsnotify.Watcher, pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	dirs, _ := filepath.Glob(filepath.Dir(pattern))
+	watching := 0
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			if err := watcher.Add(dir); err != nil {
+				return nil, err
+			}
+			watching++
+		}
+	}
+	if watching == 0 {
+		return nil, fmt.Errorf("no directory matches %s", filepath.Dir(pattern))
+	}
+
+	matches, _ := filepath.Glob(pattern)
+	var files []string
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && !isIgnored(path, false) {
+			registerWatched(path)
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// registerWatched adds a file to the list, watched
+func registerWatched(filePath string) {
+	entry := FileEntry{Path: filePath, Watched: true}
+	if info, err := os.Stat(filePath); err == nil {
+		entry.Size, entry.ModTime = info.Size(), info.ModTime()
+	}
+	fileManager.Mutex.Lock()
+	defer fileManager.Mutex.Unlock()
+	for i := range fileManager.Files {
+		if filepath.Clean(fileManager.Files[i].Path) == filePath {
+			fileManager.Files[i].Watched = true
+			fileManager.Files[i].Size, fileManager.Files[i].ModTime = entry.Size, entry.ModTime
+			return
+		}
+	}
+	fileManager.Files = append(fileManager.Files, entry)
+}
+
+// watchCreated picks up a file or directory created under a /w directory or
+// matching a /w pattern. It reports whether a single new file must be sent,
+// a new directory is sent right away
+func watchCreated(config Config, watcher *fsnotify.Watcher, path string) bool {
+	rule, exists := watchRuleFor(path)
+	if !exists {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil || isIgnored(path, info.IsDir()) {
+		return false
+	}
+	switch {
+	case info.IsDir() && !rule.Glob:
+		// Moved or copied in with its content, or filled right after
+		files, err := watchDirectory(watcher, path)
+		if err != nil {
+			logMessage("Error watching %s: %v\n", path, err)
+		}
+		saveRegistry()
+		logMessage("🕵️ Now watching: %s (%d file(s))\n", path, len(files))
+		for _, file := range files {
+			scheduleWatched(config, file)
+		}
+		return false
+	case info.Mode().IsRegular():
+		registerWatched(path)
+		saveRegistry()
+		logMessage("🕵️ Now watching: %s\n", path)
+		return true
+	}
+	return false
+}
+
+// pendingUpload is a file waiting for its writes to settle
+type pendingUpload struct {
+	timer  *time.Timer
+	since  time.Time // First event of the burst
+	upload func()
+}
+
+// uploadSchedule holds back the files being written until they settle, /w
+// uses pendingUploads and each folder sync run has its own
+type uploadSchedule struct {
+	files map[string]*pendingUpload
+	mutex sync.Mutex
+}
+
+var pendingUploads = newUploadSchedule()
+
+func newUploadSchedule() *uploadSchedule {
+	return &uploadSchedule{files: make(map[string]*pendingUpload)}
+}
+
+// schedule calls upload once filePath settles, every new event pushes it back
+func (u *uploadSchedule) schedule(filePath string, upload func()) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if pending, exists := u.files[filePath]; exists {
+		pending.timer.Reset(WatchDebounce)
+		pending.upload = upload
+		return
+	}
+	pending := &pendingUpload{since: time.Now(), upload: upload}
+	pending.timer = time.AfterFunc(WatchDebounce, func() { u.settle(filePath, pending) })
+	u.files[filePath] = pending
+}
+
+// cancel forgets a file that went away before it was sent
+func (u *uploadSchedule) cancel(filePath string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if pending, exists := u.files[filePath]; exists {
+		pending.timer.Stop()
+		delete(u.files, filePath)
+	}
+}
+
+// scheduleWatched sends a watched file once it settles
+func scheduleWatched(config Config, filePath string) {
+	pendingUploads.schedule(filePath, func() { uploadWatched(config, filePath) })
+}
+
+// stop forgets every pending file
+func (u *uploadSchedule) stop() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for filePath, pending := range u.files {
+		pending.timer.Stop()
+		delete(u.files, filePath)
+	}
+}
+
+func (u *uploadSchedule) settle(filePath string, pending *pendingUpload) {
+	stable, exists := isStable(filePath)
+	u.mutex.Lock()
+	if u.files[filePath] != pending {
+		u.mutex.Unlock()
+		return // Cancelled meanwhile
+	}
+	if exists && !stable && time.Since(pending.since) < StableMaxWait {
+		pending.timer.Reset(WatchDebounce)
+		u.mutex.Unlock()
+		return
+	}
+	delete(u.files, filePath)
+	upload := pending.upload
+	u.mutex.Unlock()
+
+	if exists {
+		upload()
+	}
+}
+
+// isStable reports whether a file stays the same size and age for a
+// StablePoll, and whether it exists at all
+func isStable(filePath string) (stable, exists bool) {
+	before, err := os.Stat(filePath)
+	if err != nil {
+		return false, false
+	}
+	time.Sleep(StablePoll)
+	after, err := os.Stat(filePath)
+	if err != nil {
+		return false, false
+	}
+	return before.Size() == after.Size() && before.ModTime().Equal(after.ModTime()), true
+}
+
+// goneFile is a watched file that was removed or renamed, what happened is
+// only known once RenameWindow is over
+type goneFile struct {
+	renamedTo string    // File created next to it in the meantime
+	size      int64     // Last seen size and modification time, a rename keeps both
+	modTime   time.Time // Zero when unknown, nothing is taken as its new name then
+}
+
+// sameFile reports whether a file created next to a gone one is that file
+// under a new name rather than an unrelated one
+func (g *goneFile) sameFile(filePath string) bool {
+	if g.modTime.IsZero() {
+		return false
+	}
+	info, err := os.Stat(filePath)
+	return err == nil && info.Mode().IsRegular() && info.Size() == g.size && info.ModTime().Equal(g.modTime)
+}
+
+// watchFiles uploads watched files to the selected peers when they change and
+// tells them when the files are deleted or renamed
+func watchFiles(config Config, watcher *fsnotify.Watcher) {
+	var (
+		gone    = make(map[string]*goneFile)
+		settled = make(chan string)
+	)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// Events name files after the watched directory, "./a" for "a"
+			filePath := filepath.Clean(event.Name)
+			watched := isWatched(filePath)
+
+			switch {
+			case event.Has(fsnotify.Create) && !watched:
+				// Possibly the new name of a watched file that just went away
+				renamed := false
+				for name, file := range gone {
+					if file.renamedTo == "" && filepath.Dir(name) == filepath.Dir(filePath) && file.sameFile(filePath) {
+						file.renamedTo = filePath
+						renamed = true
+						break
+					}
+				}
+				// Otherwise a new file of a watched directory or pattern
+				if !renamed && watchCreated(config, watcher, filePath) {
+					scheduleWatched(config, filePath)
+				}
+
+			case !watched:
+				// Another file of a watched file's directory
+
+			case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+				pendingUploads.cancel(filePath)
+				if _, exists := gone[filePath]; !exists {
+					file := &goneFile{}
+					if entry, exists := watchedEntry(filePath); exists {
+						file.size, file.modTime = entry.Size, entry.ModTime
+					}
+					gone[filePath] = file
+					time.AfterFunc(RenameWindow, func() { settled <- filePath })
+				}
+
+			case event.Has(fsnotify.Write), event.Has(fsnotify.Create):
+				noteWatched(filePath)
+				scheduleWatched(config, filePath)
+			}
+
+		case filePath := <-settled:
+			file := gone[filePath]
+			delete(gone, filePath)
+			if _, err := os.Stat(filePath); err == nil {
+				continue // Replaced in place, the Create event already sent it
+			}
+			if file.renamedTo != "" {
+				if _, err := os.Stat(file.renamedTo); err == nil {
+					renameWatched(filePath, file.renamedTo)
+					saveRegistry()
+					logMessage("🕵️ %s was renamed, now watching: %s\n", filePath, file.renamedTo)
+					propagateRemoval(config, filePath, file.renamedTo)
+					continue
+				}
+			}
+			logMessage("Watched file deleted: %s (still watched, it is sent again if it comes back)\n", filePath)
+			propagateRemoval(config, filePath, "")
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logMessage("Watcher error: %v\n", err)
+		}
+	}
+}
+
+func uploadWatched(config Config, filePath string) {
+	// Check file size before uploading
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		logMessage("Error getting file info: %v\n", err)
+		return
+	}
+
+	if fileInfo.Size() == 0 {
+		logMessage("File is empty, skipping upload: %s\n", filePath)
+		return
+	}
+
+	err = fanOut(func(session *Session) error {
+		// Check if the file was received from that peer
+		remotePath := remotePathFor(config, filePath, filePath)
+		if wasReceived(session, filePath) || inSync(session, filePath, remotePath) {
+			return nil // Ignore changes to received files
+		}
+		return sendFileWithProgress(session, filePath, remotePath)
+	})
+	if err != nil {
+		logMessage("Error uploading file: %v\n", err)
+	} else {
+		logMessage("File uploaded automatically: %s\n", filePath)
+	}
+}
+
+// propagateRemoval sends a "delete" of a watched file, or a "rename" when
+// renamedTo is set, to the selected peers
+func propagateRemoval(config Config, filePath, renamedTo string) {
+	message := Message{Action: "delete", Path: remotePathFor(config, filePath, filePath)}
+	if renamedTo != "" {
+		message.Action = "rename"
+		message.Target = remotePathFor(config, renamedTo, renamedTo)
+	}
+
+	err := fanOut(func(session *Session) error {
+		if wasReceived(session, filePath) || !session.supports(CapDelete) {
+			return nil // The peer did it or does not know how to
+		}
+		return session.send(message)
+	})
+	if err != nil {
+		logMessage("Error sending %s of %s: %v\n", message.Action, filePath, err)
+	}
+}
@@ -0,0 +1,77 @@
+// ************************************************************************** //
+//   Copyright © hi@allali.me                                                 //
+//                                                                            //
+//   File    : watch_test.go                                                  //
+//   Project : p2p                                                            //
+//   License : MIT                                                            //
+//                                                                            //
+//   Created: 2026/10/17 23:19:54 by aallali                                  //
+//   Updated: 2026/10/17 23:19:54 by aallali                                  //
+// ************************************************************************** //
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// resetWatches clears the registry and the watch rules after a test
+func resetWatches(t *testing.T) {
+	t.Cleanup(func() {
+		fileManager.Mutex.Lock()
+		fileManager.Files = nil
+		fileManager.Mutex.Unlock()
+		watchRulesMutex.Lock()
+		watchRules = nil
+		watchRulesMutex.Unlock()
+	})
+}
+
+func TestUnwatchFileKeepsRuleDirectory(t *testing.T) {
+	for _, glob := range []bool{false, true} {
+		resetWatches(t)
+		dir := t.TempDir()
+		file := filepath.Join(dir, "a.log")
+		if err := os.WriteFile(file, []byte("a"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer watcher.Close()
+
+		rule := dir
+		if glob {
+			rule = filepath.Join(dir, "*.log")
+		}
+		if count, err := watchPath(watcher, rule); err != nil || count != 1 {
+			t.Fatalf("watchPath(%s) = %d, %v", rule, count, err)
+		}
+		if err := unwatchFile(watcher, file); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Contains(watcher.WatchList(), dir) {
+			t.Errorf("%s: directory watch removed with the last file", rule)
+		}
+
+		// Without the rule nothing needs the directory any more
+		if err := unwatchPath(watcher, rule); err != nil {
+			t.Fatal(err)
+		}
+		if err := watchFile(watcher, file); err != nil {
+			t.Fatal(err)
+		}
+		if err := unwatchFile(watcher, file); err != nil {
+			t.Fatal(err)
+		}
+		if slices.Contains(watcher.WatchList(), dir) {
+			t.Errorf("%s: directory still watched after the rule and the file went", rule)
+		}
+	}
+}